@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// RequestBody provides the body sent with a request. Since a Client may send the
+// same request many times, Open is called once for each request sent.
+type RequestBody interface {
+	// Open returns a reader for a fresh copy of the body. The caller must close it.
+	Open() (io.ReadCloser, error)
+	// Len returns the length of the body in bytes
+	Len() int64
+}
+
+// BytesBody is a RequestBody held in memory
+type BytesBody []byte
+
+// Open returns a reader over the bytes in b
+func (b BytesBody) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Len returns the number of bytes in b
+func (b BytesBody) Len() int64 {
+	return int64(len(b))
+}
+
+// FileBody is a RequestBody that is streamed from a file each time it is sent
+// rather than being loaded into memory. The file should not change size while
+// requests are being sent.
+type FileBody struct {
+	path string
+	size int64
+}
+
+// NewFileBody returns a FileBody that sends the contents of the file at path
+func NewFileBody(path string) (*FileBody, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBody{path: path, size: info.Size()}, nil
+}
+
+// Open opens the file for reading from the beginning
+func (fb *FileBody) Open() (io.ReadCloser, error) {
+	return os.Open(fb.path)
+}
+
+// Len returns the size of the file when the FileBody was created
+func (fb *FileBody) Len() int64 {
+	return fb.size
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ChunkedEncodingError reports a response body that does not follow the framing
+// rules of the chunked transfer coding
+type ChunkedEncodingError struct {
+	Reason string
+}
+
+func (e *ChunkedEncodingError) Error() string {
+	return "invalid chunked encoding: " + e.Reason
+}
+
+// chunkedReader decodes a response body sent using the chunked transfer coding.
+// Once the last chunk has been read the trailer fields that follow it are parsed
+// into Trailer and Read returns io.EOF, leaving reader positioned at the start of
+// the next response.
+// See https://tools.ietf.org/html/rfc7230#section-4.1
+type chunkedReader struct {
+	reader *bufio.Reader
+	tp     *textproto.Reader
+	// Number of bytes left to read from the current chunk
+	remaining uint64
+	// Whether the CRLF following the current chunk's data still needs to be read
+	needCRLF bool
+	err      error
+	Trailer  textproto.MIMEHeader
+}
+
+func newChunkedReader(reader *bufio.Reader) *chunkedReader {
+	return &chunkedReader{reader: reader, tp: textproto.NewReader(reader)}
+}
+
+func (cr *chunkedReader) Read(buf []byte) (n int, err error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.remaining == 0 {
+		if cr.err = cr.nextChunk(); cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	if uint64(len(buf)) > cr.remaining {
+		buf = buf[:cr.remaining]
+	}
+	n, err = cr.reader.Read(buf)
+	cr.remaining -= uint64(n)
+	if err == io.EOF {
+		// The connection closed in the middle of a chunk
+		err = io.ErrUnexpectedEOF
+	}
+	cr.err = err
+	return n, err
+}
+
+// nextChunk reads up to the start of the next chunk's data, or parses the trailer
+// and returns io.EOF if the last chunk has been reached
+func (cr *chunkedReader) nextChunk() error {
+	if cr.needCRLF {
+		crlf := make([]byte, 2)
+		if _, err := io.ReadFull(cr.reader, crlf); err != nil {
+			return unexpectedEOF(err)
+		}
+		if string(crlf) != "\r\n" {
+			return &ChunkedEncodingError{Reason: "missing CRLF after chunk data"}
+		}
+		cr.needCRLF = false
+	}
+	line, err := cr.tp.ReadLine()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	// Ignore chunk extensions
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	size, err := strconv.ParseUint(line, 16, 63)
+	if err != nil {
+		return &ChunkedEncodingError{Reason: fmt.Sprintf("bad chunk size %q", line)}
+	}
+	if size == 0 {
+		cr.Trailer, err = cr.tp.ReadMIMEHeader()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return io.ErrUnexpectedEOF
+			}
+			return &ChunkedEncodingError{Reason: "bad trailer: " + err.Error()}
+		}
+		return io.EOF
+	}
+	cr.remaining = size
+	cr.needCRLF = true
+	return nil
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF since the body of a
+// chunked response must end with the last chunk rather than a closed connection
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"jockey/counter"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// persistConn is an established connection to a server along with the state
+// needed to read several responses from it when keep-alive is enabled
+type persistConn struct {
+	// conn is the outermost connection, which is a TLS connection for https
+	conn net.Conn
+	// counts tracks the number of bytes read from conn including bytes still
+	// buffered in reader
+	counts *counter.Reader
+	reader *bufio.Reader
+}
+
+// connPool holds idle keep-alive connections keyed by scheme and host. The zero
+// value is an empty pool.
+type connPool struct {
+	mu   sync.Mutex
+	idle map[string][]*persistConn
+}
+
+// get removes and returns an idle connection for key, or nil if there is none
+func (p *connPool) get(key string) *persistConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	pc := conns[len(conns)-1]
+	p.idle[key] = conns[:len(conns)-1]
+	return pc
+}
+
+// put returns a connection to the pool so that it can be reused by later requests
+func (p *connPool) put(key string, pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[string][]*persistConn)
+	}
+	p.idle[key] = append(p.idle[key], pc)
+}
+
+// poolKey returns the key identifying connections that can serve requestURL
+func poolKey(requestURL *url.URL) string {
+	return requestURL.Scheme + "://" + requestURL.Host
+}
+
+// dialConn opens a new connection to the host in requestURL, through the proxy if
+// the Client has one, negotiating TLS if required, and records the time taken by
+// each phase in timings. Connecting and the TLS handshake must complete within
+// the Client's timeouts for them and before deadline if it is not zero, and are
+// abandoned if ctx is cancelled.
+func (c *Client) dialConn(ctx context.Context, requestURL *url.URL, deadline time.Time,
+	timings *PhaseTimings) (*persistConn, error) {
+
+	connect := c.limit("connect", c.ConnectTimeout, deadline)
+	connectCtx, cancel := connect.context(ctx)
+	defer cancel()
+	tcpConn, err := c.dialTarget(connectCtx, requestURL, timings)
+	if err != nil {
+		return nil, connect.wrap(err)
+	}
+	pc := &persistConn{conn: tcpConn}
+
+	// Negotiate TLS if required
+	if requestURL.Scheme == "https" {
+		var config *tls.Config
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		} else {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = requestURL.Hostname()
+		}
+		tlsConn := tls.Client(tcpConn, config)
+		handshake := c.limit("TLS", c.TLSTimeout, deadline)
+		_ = tlsConn.SetDeadline(handshake.deadline)
+		stopClosing := context.AfterFunc(ctx, func() { tcpConn.Close() })
+		start := time.Now()
+		err = tlsConn.Handshake()
+		timings.TLSHandshake = time.Since(start)
+		stopClosing()
+		if err != nil {
+			tlsConn.Close()
+			if isTimeout(err) {
+				return nil, handshake.wrap(err)
+			}
+			return nil, newTLSHandshakeError(err)
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		if tlsConn.ConnectionState().DidResume {
+			timings.ResumedTLSHandshake = timings.TLSHandshake
+		}
+		pc.conn = tlsConn
+	}
+	pc.counts = counter.NewReader(pc.conn)
+	pc.reader = bufio.NewReaderSize(pc.counts, os.Getpagesize()*16)
+	return pc, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// acceptEncoding lists the content codings that newContentDecoder can remove
+const acceptEncoding = "gzip, deflate"
+
+// newContentDecoder returns a reader that removes the content codings listed in
+// encoding, in the order they were applied, from body.
+// See https://tools.ietf.org/html/rfc7231#section-3.1.2.2
+func newContentDecoder(body io.Reader, encoding string) (io.Reader, error) {
+	codings := strings.Split(encoding, ",")
+	decoded := body
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "gzip", "x-gzip":
+			decoded, err = gzip.NewReader(decoded)
+		case "deflate":
+			decoded, err = newDeflateReader(decoded)
+		case "identity", "":
+		default:
+			err = fmt.Errorf("unsupported Content-Encoding: %s", coding)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+// newDeflateReader decodes the deflate content coding, which is defined as zlib
+// data but is sent as raw deflate data by some servers
+func newDeflateReader(body io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(body)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// A zlib header declares the deflate method and has a checksum
+	// See https://tools.ietf.org/html/rfc1950#section-2.2
+	if header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// ErrorClass groups the errors returned by Client.Do by their likely cause
+type ErrorClass string
+
+const (
+	// ErrorDNS means the target host name could not be resolved
+	ErrorDNS ErrorClass = "dns"
+	// ErrorConnect means a connection to the target could not be established
+	ErrorConnect ErrorClass = "connect"
+	// ErrorTimeout means the request exceeded one of the Client's timeouts or an
+	// operation on the connection timed out
+	ErrorTimeout ErrorClass = "timeout"
+	// ErrorEOF means the server closed the connection before completing its response
+	ErrorEOF ErrorClass = "eof"
+	// ErrorReset means the connection was reset or closed while it was being written
+	ErrorReset ErrorClass = "reset"
+	// ErrorTLSVerify means the server's TLS certificate could not be verified
+	ErrorTLSVerify ErrorClass = "tls_verify"
+	// ErrorTLS means the TLS handshake failed for a reason other than verification
+	ErrorTLS ErrorClass = "tls"
+	// ErrorProtocol means the server sent a response that is not valid HTTP, such as
+	// a bad status line or header
+	ErrorProtocol ErrorClass = "protocol"
+	// ErrorChunkedEncoding means the server sent a chunked response body with
+	// invalid framing
+	ErrorChunkedEncoding ErrorClass = "chunked_encoding"
+	// ErrorProxy means the proxy could not open a tunnel to the target
+	ErrorProxy ErrorClass = "proxy"
+	// ErrorRedirect means redirects could not be followed to a final response
+	ErrorRedirect ErrorClass = "redirect"
+	// ErrorOther is used for errors that do not fit any other class
+	ErrorOther ErrorClass = "other"
+)
+
+// ProtocolError reports a response that does not follow the HTTP/1.1 message syntax
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "malformed response: " + e.Reason
+}
+
+// ClassifyError returns the class of an error returned by Client.Do, or an empty
+// class if err is nil
+func ClassifyError(err error) ErrorClass {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var chunkedErr *ChunkedEncodingError
+	var tlsErr *TLSHandshakeError
+	var redirectErr *RedirectError
+	var timeoutErr *TimeoutError
+	var proxyErr *ProxyError
+	var protocolErr *ProtocolError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &timeoutErr):
+		return ErrorTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case isCertificateError(err):
+		return ErrorTLSVerify
+	case errors.As(err, &tlsErr):
+		return ErrorTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrorConnect
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return ErrorReset
+	case errors.As(err, &protocolErr):
+		return ErrorProtocol
+	case errors.As(err, &chunkedErr):
+		return ErrorChunkedEncoding
+	case errors.As(err, &proxyErr):
+		return ErrorProxy
+	case errors.As(err, &redirectErr):
+		return ErrorRedirect
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorEOF
+	}
+	return ErrorOther
+}
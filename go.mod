@@ -1,3 +1,3 @@
 module jockey
 
-go 1.13
+go 1.24
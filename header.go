@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// HeaderField is a single HTTP header field
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Header is an ordered list of HTTP header fields. Unlike a map it preserves the
+// order in which fields were added and allows a name to appear more than once.
+// Names are compared case-insensitively.
+type Header []HeaderField
+
+// Add appends a field to the end of the header
+func (h *Header) Add(name, value string) {
+	*h = append(*h, HeaderField{Name: name, Value: value})
+}
+
+// Get returns the value of the first field called name, or an empty string if
+// there is no such field
+func (h Header) Get(name string) string {
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Has reports whether the header contains at least one field called name
+func (h Header) Has(name string) bool {
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasToken reports whether any field called name holds token in its
+// comma-separated list of values, such as close in "Connection: TE, close".
+// Tokens are compared case-insensitively.
+func (h Header) hasToken(name, token string) bool {
+	for _, field := range h {
+		if !strings.EqualFold(field.Name, name) {
+			continue
+		}
+		for _, value := range strings.Split(field.Value, ",") {
+			if strings.EqualFold(strings.TrimSpace(value), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseHeaderField parses a header field in the form "Name: value"
+func ParseHeaderField(line string) (HeaderField, error) {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return HeaderField{}, fmt.Errorf("invalid header %q: expected Name: value", line)
+	}
+	name, value := line[:i], strings.TrimSpace(line[i+1:])
+	// Header names are tokens and values may not span multiple lines
+	// See https://tools.ietf.org/html/rfc7230#section-3.2
+	if name == "" || strings.ContainsAny(name, " \t\r\n\"(),/:;<=>?@[\\]{}") {
+		return HeaderField{}, fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return HeaderField{}, fmt.Errorf("invalid value for header %s", name)
+	}
+	return HeaderField{Name: name, Value: value}, nil
+}
+
+// readHeader reads header fields from tp up to the blank line that ends them,
+// keeping their order and the case of their names. Values folded over several
+// lines are joined. Fields that cannot be parsed are reported as a ProtocolError.
+func readHeader(tp *textproto.Reader) (Header, error) {
+	var header Header
+	for {
+		line, err := tp.ReadContinuedLine()
+		if err != nil {
+			return header, err
+		}
+		if line == "" {
+			return header, nil
+		}
+		field, err := ParseHeaderField(line)
+		if err != nil {
+			return header, &ProtocolError{Reason: err.Error()}
+		}
+		header = append(header, field)
+	}
+}
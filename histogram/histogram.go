@@ -0,0 +1,174 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Histogram counts int64 values in logarithmically sized buckets, in the style of
+// HdrHistogram. Each power of two range of values is split into the same number
+// of linear sub-buckets, so every value up to the highest trackable value is
+// recorded with the configured number of significant decimal digits while the
+// memory used depends only on the range and precision, never on the number of
+// values recorded.
+// See http://hdrhistogram.org
+//
+// A value v recorded by a Histogram with d significant digits is reported as a
+// value between v and v plus the larger of v/10^d and the lowest discernible
+// value. Histogram is not safe for concurrent use.
+type Histogram struct {
+	highest int64
+	// Values below 1<<unitMagnitude share the first sub-bucket
+	unitMagnitude uint
+	// Each bucket has subBucketCount sub-buckets, the lower half of which overlap
+	// the previous bucket and are only used by the first bucket
+	subBucketHalfCountMagnitude uint
+	subBucketCount              int
+	subBucketHalfCount          int
+	subBucketMask               int64
+	counts                      []int64
+	total                       int64
+	min                         int64
+	max                         int64
+}
+
+// New returns a Histogram that records values from 0 to highest, distinguishing
+// values at least lowest apart and keeping significantDigits significant decimal
+// digits. New panics if lowest is less than 1, highest is less than twice lowest
+// or significantDigits is not between 1 and 5.
+func New(lowest, highest int64, significantDigits int) *Histogram {
+	if lowest < 1 || highest < 2*lowest || significantDigits < 1 || significantDigits > 5 {
+		panic(fmt.Sprintf("histogram: invalid range %d to %d with %d significant digits",
+			lowest, highest, significantDigits))
+	}
+	// The sub-buckets must be fine enough to tell 10^d apart from 10^d + 1
+	largestWithUnitResolution := 2 * int64(math.Pow10(significantDigits))
+	subBucketCountMagnitude := uint(bits.Len64(uint64(largestWithUnitResolution - 1)))
+	h := &Histogram{
+		highest:                     highest,
+		unitMagnitude:               uint(bits.Len64(uint64(lowest)) - 1),
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+		subBucketCount:              1 << subBucketCountMagnitude,
+		min:                         math.MaxInt64,
+	}
+	h.subBucketHalfCount = h.subBucketCount / 2
+	h.subBucketMask = int64(h.subBucketCount-1) << h.unitMagnitude
+
+	// Each bucket covers twice the range of the previous one
+	smallestUntrackable := int64(h.subBucketCount) << h.unitMagnitude
+	bucketCount := 1
+	for smallestUntrackable <= highest {
+		bucketCount++
+		if smallestUntrackable > math.MaxInt64/2 {
+			break
+		}
+		smallestUntrackable <<= 1
+	}
+	h.counts = make([]int64, (bucketCount+1)*h.subBucketHalfCount)
+	return h
+}
+
+// Record counts value once. Values below zero are recorded as zero and values
+// above the highest trackable value are recorded as the highest trackable value.
+func (h *Histogram) Record(value int64) {
+	if value < 0 {
+		value = 0
+	} else if value > h.highest {
+		value = h.highest
+	}
+	h.counts[h.countsIndex(value)]++
+	h.total++
+	if value < h.min {
+		h.min = value
+	}
+	if value > h.max {
+		h.max = value
+	}
+}
+
+// Count returns the number of values recorded
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Min returns the smallest value recorded, or 0 if no values were recorded
+func (h *Histogram) Min() int64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.min
+}
+
+// Max returns the largest value recorded, or 0 if no values were recorded
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+// ValueAtPercentile returns the value at percentile p, where 0 < p <= 100, using
+// the nearest-rank method. The result is the highest value equivalent to the
+// smallest recorded value such that at least p percent of recorded values are
+// less than or equal to it, limited to the largest value recorded. It returns 0
+// if no values were recorded or p is out of range. Each call takes time in
+// proportion to the size of the histogram rather than the number of values.
+func (h *Histogram) ValueAtPercentile(p float64) int64 {
+	if h.total == 0 || p <= 0 || p > 100 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			value := h.highestEquivalentValue(h.valueFromIndex(i))
+			if value > h.max {
+				value = h.max
+			}
+			return value
+		}
+	}
+	return h.max
+}
+
+// bucketIndex returns the index of the bucket holding value
+func (h *Histogram) bucketIndex(value int64) int {
+	// The mask keeps values that fit in the first bucket from producing a
+	// negative index
+	pow2Ceiling := bits.Len64(uint64(value | h.subBucketMask))
+	return pow2Ceiling - int(h.unitMagnitude) - int(h.subBucketHalfCountMagnitude+1)
+}
+
+// subBucketIndex returns the index of the sub-bucket holding value within bucket
+func (h *Histogram) subBucketIndex(value int64, bucket int) int {
+	return int(value >> (uint(bucket) + h.unitMagnitude))
+}
+
+// countsIndex returns the index in counts of the sub-bucket holding value
+func (h *Histogram) countsIndex(value int64) int {
+	bucket := h.bucketIndex(value)
+	subBucket := h.subBucketIndex(value, bucket)
+	return (bucket+1)<<h.subBucketHalfCountMagnitude + subBucket - h.subBucketHalfCount
+}
+
+// valueFromIndex returns the lowest value counted at index in counts
+func (h *Histogram) valueFromIndex(index int) int64 {
+	bucket := index>>h.subBucketHalfCountMagnitude - 1
+	subBucket := index&(h.subBucketHalfCount-1) + h.subBucketHalfCount
+	if bucket < 0 {
+		subBucket -= h.subBucketHalfCount
+		bucket = 0
+	}
+	return int64(subBucket) << (uint(bucket) + h.unitMagnitude)
+}
+
+// highestEquivalentValue returns the largest value counted in the same sub-bucket
+// as value
+func (h *Histogram) highestEquivalentValue(value int64) int64 {
+	bucket := h.bucketIndex(value)
+	shift := uint(bucket) + h.unitMagnitude
+	lowestEquivalent := int64(h.subBucketIndex(value, bucket)) << shift
+	return lowestEquivalent + int64(1)<<shift - 1
+}
@@ -0,0 +1,105 @@
+package histogram
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Percentiles should be within the precision of the histogram, or its lowest
+// discernible value, of the exact nearest-rank percentiles of the recorded values
+func TestValueAtPercentile(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	for _, digits := range []int{1, 2, 3, 4, 5} {
+		h := New(1000, int64(time.Hour), digits)
+		values := make([]int64, 10_000)
+		for i := range values {
+			// Spread the values over several orders of magnitude
+			values[i] = int64(math.Exp(rand.Float64()*20)) + 1000
+			h.Record(values[i])
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		if h.Count() != int64(len(values)) || h.Min() != values[0] || h.Max() != values[len(values)-1] {
+			t.Errorf("%d digits: unexpected count %d, min %d or max %d\n", digits, h.Count(), h.Min(),
+				h.Max())
+		}
+		for _, p := range []float64{0.1, 1, 25, 50, 75, 90, 99, 99.9, 99.99, 100} {
+			rank := int(math.Ceil(p / 100 * float64(len(values))))
+			exact := values[rank-1]
+			got := h.ValueAtPercentile(p)
+			tolerance := math.Max(float64(exact)/math.Pow10(digits), 1000)
+			if got < exact || float64(got-exact) > tolerance {
+				t.Errorf("%d digits: p%v expected %d within %d significant digits, got %d\n",
+					digits, p, exact, digits, got)
+			}
+		}
+		if h.ValueAtPercentile(100) != h.Max() {
+			t.Errorf("%d digits: expected p100 to equal max %d, got %d\n", digits, h.Max(),
+				h.ValueAtPercentile(100))
+		}
+	}
+}
+
+// Every value in the trackable range should map to a sub-bucket that contains it
+func TestCountsIndex(t *testing.T) {
+	h := New(1, 1<<40, 3)
+	for i := 0; i < 100_000; i++ {
+		value := rand.Int63n(1 << 40)
+		index := h.countsIndex(value)
+		if index < 0 || index >= len(h.counts) {
+			t.Fatalf("value %d mapped to index %d outside counts of length %d\n", value, index,
+				len(h.counts))
+		}
+		lowest := h.valueFromIndex(index)
+		if value < lowest || value > h.highestEquivalentValue(lowest) {
+			t.Errorf("value %d outside sub-bucket %d to %d\n", value, lowest,
+				h.highestEquivalentValue(lowest))
+		}
+	}
+}
+
+// Values outside the trackable range should be clamped rather than lost
+func TestRecordOutOfRange(t *testing.T) {
+	h := New(1, 1000, 2)
+	h.Record(-5)
+	h.Record(math.MaxInt64)
+	if h.Count() != 2 || h.Min() != 0 || h.Max() != 1000 {
+		t.Errorf("expected values clamped to 0 and 1000, got count %d min %d max %d\n", h.Count(),
+			h.Min(), h.Max())
+	}
+	if h.ValueAtPercentile(50) != 0 || h.ValueAtPercentile(100) != 1000 {
+		t.Errorf("unexpected percentiles p50 %d p100 %d\n", h.ValueAtPercentile(50),
+			h.ValueAtPercentile(100))
+	}
+	empty := New(1, 1000, 2)
+	if empty.ValueAtPercentile(50) != 0 || empty.Min() != 0 || empty.Max() != 0 {
+		t.Errorf("expected zero values from empty histogram\n")
+	}
+}
+
+// The size of a histogram should depend only on its range and precision
+func TestSize(t *testing.T) {
+	h := New(1000, int64(time.Hour), 3)
+	size := len(h.counts)
+	for i := 0; i < 1_000_000; i++ {
+		h.Record(rand.Int63n(int64(time.Hour)))
+	}
+	if len(h.counts) != size || size > 64*1024 {
+		t.Errorf("expected a fixed size of at most 64k counts, got %d then %d\n", size, len(h.counts))
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, args := range [][3]int64{{0, 100, 3}, {10, 15, 3}, {1, 100, 0}, {1, 100, 6}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected New%v to panic\n", args)
+				}
+			}()
+			New(args[0], args[1], int(args[2]))
+		}()
+	}
+}
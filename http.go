@@ -2,18 +2,22 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"jockey/counter"
 	"net"
+	"net/http"
 	"net/textproto"
 	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,10 +27,399 @@ const urlSchemeRegex = "^([a-zA-Z]+)://"
 // Note that this excludes the trailing \r\n since it is stripped prior to matching
 const statusLineRegex = `^(?:HTTP|http)/\d\.\d (\d{3}) (?:[\x21-\x7E\x80-\xFF][\x20-\x7E\x80-\xFF]*)*$`
 
+// PhaseTimings breaks the time taken by a single request down by phase. Phases
+// that were skipped, such as the DNS lookup for an IP address or the TLS
+// handshake for plain HTTP, are zero.
+type PhaseTimings struct {
+	DNSLookup time.Duration
+	Connect   time.Duration
+	// ProxyConnect is the time taken to open a tunnel to the target through a
+	// proxy after connecting to the proxy
+	ProxyConnect time.Duration
+	TLSHandshake time.Duration
+	// ResumedTLSHandshake is the part of TLSHandshake taken by handshakes that
+	// resumed an earlier session. Each hop of a redirected request may perform
+	// its own handshake, so it is kept separately rather than as a flag.
+	ResumedTLSHandshake time.Duration
+	// FirstByte is the time between sending the request and reading the first
+	// byte of the response
+	FirstByte time.Duration
+	// Transfer is the time between reading the first byte of the response and
+	// reading the end of the response
+	Transfer time.Duration
+	// Stream is the time between sending the request and reading the end of the
+	// response for HTTP/2 requests, whose streams may share a connection with
+	// other requests. It is zero for HTTP/1.1 requests.
+	Stream time.Duration
+}
+
+// Result describes the outcome of a single HTTP request
+type Result struct {
+	// HTTP status code of the response
+	Status int
+	// Number of bytes read from the response including headers
+	BytesRead int
+	// Number of body bytes written to the writer passed to Do, which differs from
+	// the size of the body sent by the server if a content coding was removed
+	BodyBytes int
+	Timings   PhaseTimings
+	// Number of connections opened and reused to complete the request
+	ConnectionsOpened int
+	ConnectionsReused int
+	// Header holds the header fields of the response in the order they were received
+	Header Header
+	// Trailer fields sent after the body of a chunked response
+	Trailer textproto.MIMEHeader
+	// TLS holds the state of the connection used for https requests
+	TLS *tls.ConnectionState
+	// Hops describes each request sent while following redirects, starting with
+	// the original request. It is empty unless the Client follows redirects, in
+	// which case BytesRead, Timings and the connection counts are totals over
+	// every hop while the other fields describe the final response.
+	Hops []Hop
+}
+
+// Hop describes one of the requests sent by a Client following redirects
+type Hop struct {
+	URL    *url.URL
+	Status int
+	// Elapsed is the total time taken by the request
+	Elapsed time.Duration
+	Timings PhaseTimings
+}
+
+// add accumulates the outcome of a single hop of a redirected request
+func (r *Result) add(hop *Result) {
+	r.Status = hop.Status
+	r.BytesRead += hop.BytesRead
+	r.BodyBytes = hop.BodyBytes
+	r.Timings.DNSLookup += hop.Timings.DNSLookup
+	r.Timings.Connect += hop.Timings.Connect
+	r.Timings.ProxyConnect += hop.Timings.ProxyConnect
+	r.Timings.TLSHandshake += hop.Timings.TLSHandshake
+	r.Timings.ResumedTLSHandshake += hop.Timings.ResumedTLSHandshake
+	r.Timings.FirstByte += hop.Timings.FirstByte
+	r.Timings.Transfer += hop.Timings.Transfer
+	r.Timings.Stream += hop.Timings.Stream
+	r.ConnectionsOpened += hop.ConnectionsOpened
+	r.ConnectionsReused += hop.ConnectionsReused
+	r.Header = hop.Header
+	r.Trailer = hop.Trailer
+	r.TLS = hop.TLS
+}
+
+// Client sends HTTP requests using the settings stored in its fields. The zero
+// value is ready to use. A Client must not be copied after first use.
+type Client struct {
+	// Headers are sent with every request. They replace any defaults used by
+	// SendRequest with the same name.
+	Headers Header
+	// Method is the HTTP method of each request, or GET if empty
+	Method string
+	// Body is sent with every request if it is not nil
+	Body RequestBody
+	// TLSConfig configures https connections. If it is nil server certificates are
+	// verified against the system roots. The server name is set from the request
+	// URL unless the configuration specifies one.
+	TLSConfig *tls.Config
+	// KeepAlive asks servers to keep connections open after each response so that
+	// they can be reused by later requests sent by the Client
+	KeepAlive bool
+	// FollowRedirects makes Do follow responses with a redirect status and a
+	// Location header, up to MaxRedirects times per request. Relative locations
+	// are resolved against the URL of the request that was redirected. Following
+	// a redirect to a request that was already sent is reported as a loop. Once
+	// a redirect leads to another host or scheme, any Authorization, Cookie and
+	// Host fields in Headers are no longer sent.
+	FollowRedirects bool
+	MaxRedirects    int
+	// Compressed asks servers to compress responses using the gzip or deflate
+	// content codings and removes them from response bodies before they are
+	// written. Responses using other content codings fail.
+	Compressed bool
+	// HeadWriter receives the status line and header fields of each response,
+	// followed by a blank line, before its body is written if it is not nil.
+	// Responses to redirects followed by Do are included.
+	HeadWriter io.Writer
+	// Proxy is the URL of an HTTP or SOCKS5 proxy that requests are sent through,
+	// if it is not nil; see ParseProxyURL. Plain HTTP/1.1 requests are forwarded
+	// by HTTP proxies while https and HTTP/2 requests are tunnelled using CONNECT.
+	// Credentials in the URL are used to authenticate with the proxy.
+	Proxy *url.URL
+	// Resolve maps host:port pairs to the IP addresses used to connect to them
+	// instead of looking up the host; see ParseResolve. If several addresses are
+	// given for a host, new connections use each of them in turn. The Host header
+	// and TLS server name are still taken from the request URL.
+	Resolve map[string][]string
+	// ConnectTo replaces the host and port connected to for requests that match
+	// one of its entries; see ParseConnectTo. Entries are applied before Resolve.
+	//
+	// With a Proxy, Resolve and ConnectTo apply to the address that tunnels are
+	// opened to rather than to the proxy. They are ignored for plain HTTP/1.1
+	// requests forwarded by an HTTP proxy, which connects to the host in the URL.
+	ConnectTo []ConnectTo
+	// ConnectTimeout limits the time taken to look up the host and connect to it,
+	// including opening a tunnel through a proxy. TLSTimeout limits the TLS
+	// handshake and FirstByteTimeout limits the time between sending a request and
+	// reading the first byte of the response. Timeout limits the time taken by Do
+	// as a whole, including any redirects. Zero values mean no limit. Requests that
+	// exceed a timeout fail with a TimeoutError.
+	ConnectTimeout   time.Duration
+	TLSTimeout       time.Duration
+	FirstByteTimeout time.Duration
+	Timeout          time.Duration
+	// Dialer opens the Client's connections, including those to a proxy. If it is
+	// nil connections are made over TCP after applying Resolve and ConnectTo, which
+	// are otherwise ignored.
+	Dialer Dialer
+	// HTTP2 sends requests using HTTP/2 instead of HTTP/1.1. It is negotiated using
+	// ALPN for https and used with prior knowledge (h2c) for http, and requests
+	// fail if the server does not support it. Concurrent requests to the same
+	// host are multiplexed over a shared connection, so KeepAlive has no effect.
+	HTTP2 bool
+
+	pool   connPool
+	h2Once sync.Once
+	h2     *http.Transport
+	// Index of the next address used for each host in Resolve
+	resolveMu   sync.Mutex
+	resolveNext map[string]int
+}
+
+// Do sends a single HTTP request corresponding to the request URI in requestURL to
+// the host specified in requestURL using the method and body configured in the
+// Client. The HTTP response body (omitting headers) is written to writer.
+//
+// A new TCP connection is opened for each request unless KeepAlive is set, in
+// which case an idle connection left open by an earlier request is reused if one
+// is available. If a reused connection turns out to have been closed by the server
+// requests with idempotent methods are retried once on a new connection.
+//
+// If FollowRedirects is set, redirect responses are followed as described by
+// FollowRedirects and only the body of the final response is written to writer.
+//
+// The caller can abort a request by passing an abort channel as an argument. The
+// request will be aborted after an optional timeout if a duration is written to
+// the abort channel or if the channel is closed.
+//
+// The returned Result is never nil. If an error occurs it holds whatever was
+// measured before the request failed.
+func (c *Client) Do(requestURL *url.URL, writer io.Writer, abort chan time.Duration) (
+	*Result, error) {
+
+	result := &Result{}
+	req := request{url: requestURL, method: c.method(), body: c.Body}
+	if c.Timeout > 0 {
+		req.deadline = time.Now().Add(c.Timeout)
+	}
+	ctx, cancel := abortContext(abort)
+	defer cancel()
+	if !c.FollowRedirects {
+		_, err := c.send(ctx, req, func(*response) io.Writer { return writer }, result)
+		return result, err
+	}
+	// Discard the bodies of responses that will be followed
+	bodyWriter := func(resp *response) io.Writer {
+		if isRedirect(resp.status) && resp.header.Get("Location") != "" {
+			return ioutil.Discard
+		}
+		return writer
+	}
+	visited := map[string]bool{req.key(): true}
+	for {
+		hop := &Result{}
+		start := time.Now()
+		resp, err := c.send(ctx, req, bodyWriter, hop)
+		result.add(hop)
+		result.Hops = append(result.Hops, Hop{
+			URL:     req.url,
+			Status:  hop.Status,
+			Elapsed: time.Since(start),
+			Timings: hop.Timings,
+		})
+		location := resp.header.Get("Location")
+		if err != nil || !isRedirect(resp.status) || location == "" {
+			return result, err
+		}
+		if len(result.Hops) > c.MaxRedirects {
+			return result, &RedirectError{
+				Reason: fmt.Sprintf("stopped after %d redirects", c.MaxRedirects)}
+		}
+		req, err = req.redirect(resp.status, location)
+		if err != nil {
+			return result, err
+		}
+		if visited[req.key()] {
+			return result, &RedirectError{Reason: "redirect loop at " + req.key()}
+		}
+		visited[req.key()] = true
+	}
+}
+
+// send sends a single request without following redirects, reusing a pooled
+// connection if possible, and records the outcome in result. The request is
+// abandoned if ctx is cancelled.
+func (c *Client) send(ctx context.Context, req request, bodyWriter func(*response) io.Writer,
+	result *Result) (response, error) {
+
+	if c.HeadWriter != nil {
+		writeBody := bodyWriter
+		bodyWriter = func(resp *response) io.Writer {
+			writeHead(c.HeadWriter, resp)
+			return writeBody(resp)
+		}
+	}
+	if c.HTTP2 {
+		return c.sendHTTP2(ctx, req, bodyWriter, result)
+	}
+	key := poolKey(req.url)
+	var pc *persistConn
+	if c.KeepAlive {
+		pc = c.pool.get(key)
+	}
+	if pc != nil {
+		resp, err := c.roundTrip(ctx, pc, req, bodyWriter, result)
+		// A server may close an idle connection at any time, in which case the
+		// request fails before any part of the response is received
+		if err == nil || result.BytesRead > 0 || !idempotent(req.method) || isTimeout(err) {
+			result.ConnectionsReused++
+			return resp, err
+		}
+	}
+	pc, err := c.dialConn(ctx, req.url, req.deadline, &result.Timings)
+	if err != nil {
+		return response{}, err
+	}
+	result.ConnectionsOpened++
+	return c.roundTrip(ctx, pc, req, bodyWriter, result)
+}
+
+// method returns the HTTP method used by the Client's requests
+func (c *Client) method() string {
+	if c.Method == "" {
+		return "GET"
+	}
+	return c.Method
+}
+
+// headers returns the headers sent with req, adding any implied by the Client's
+// settings that the caller has not set and leaving out those that must not
+// follow a redirect to another host or scheme
+func (c *Client) headers(req request) Header {
+	headers := c.Headers
+	if req.crossOrigin {
+		headers = make(Header, 0, len(c.Headers))
+		for _, field := range c.Headers {
+			if !crossOriginHeaders[textproto.CanonicalMIMEHeaderKey(field.Name)] {
+				headers = append(headers, field)
+			}
+		}
+	}
+	if c.KeepAlive && !headers.Has("Connection") {
+		headers = append(Header{{"Connection", "keep-alive"}}, headers...)
+	}
+	if c.Compressed && !headers.Has("Accept-Encoding") {
+		headers = append(Header{{"Accept-Encoding", acceptEncoding}}, headers...)
+	}
+	return headers
+}
+
+// idempotent reports whether sending a request using method more than once has
+// the same effect as sending it once
+// See https://tools.ietf.org/html/rfc7231#section-4.2.2
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// roundTrip sends req over pc and reads the response into the writer returned by
+// bodyWriter and into result. If the connection can carry another request it is
+// returned to the pool, otherwise it is closed. Cancelling ctx closes the
+// connection to unblock the exchange.
+func (c *Client) roundTrip(ctx context.Context, pc *persistConn, req request,
+	bodyWriter func(*response) io.Writer, result *Result) (response, error) {
+
+	if tlsConn, ok := pc.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		result.TLS = &state
+	}
+	// Clear any deadline left over from the previous request on the connection
+	total := c.limit("total", 0, req.deadline)
+	_ = pc.conn.SetDeadline(total.deadline)
+	// SendRequest closes conn on error
+	target, headers := req.url.RequestURI(), c.headers(req)
+	if c.forwardsHTTP(req.url) {
+		// The proxy forwards the request itself rather than tunnelling it
+		target = req.url.Scheme + "://" + req.url.Host + target
+		if auth := proxyAuthorization(c.Proxy); auth != "" && !headers.Has("Proxy-Authorization") {
+			// headers may share its backing array with c.Headers, which concurrent
+			// requests read, so the field must not be appended in place
+			headers = append(headers[:len(headers):len(headers)],
+				HeaderField{"Proxy-Authorization", auth})
+		}
+	}
+	stopClosing := context.AfterFunc(ctx, func() { pc.conn.Close() })
+	defer stopClosing()
+	err := writeRequest(pc.conn, req.method, target, req.url, headers, req.body)
+	if err != nil {
+		return response{}, total.wrap(err)
+	}
+	sent := time.Now()
+	// The first byte timeout gives way to the total timeout once the first byte
+	// of the response is read. Waiting for it through the buffered reader rather
+	// than on the TCP connection skips TLS records that are not part of the
+	// response, such as session tickets sent after the handshake.
+	firstByte := c.limit("first byte", c.FirstByteTimeout, req.deadline)
+	_ = pc.conn.SetReadDeadline(firstByte.deadline)
+	countBefore := pc.counts.Count()
+	if _, err := pc.reader.Peek(1); err != nil {
+		result.BytesRead = int(pc.counts.Count() - countBefore)
+		pc.conn.Close()
+		return response{}, firstByte.wrap(err)
+	}
+	firstRead := time.Now()
+	_ = pc.conn.SetReadDeadline(total.deadline)
+	resp, err := readResponse(pc.conn, pc.reader, bodyWriter, nil, req.method == "HEAD",
+		c.Compressed)
+	err = total.wrap(err)
+	result.Status = resp.status
+	result.Header = resp.header
+	result.BodyBytes = int(resp.bodyBytes)
+	result.Trailer = resp.trailer
+	result.BytesRead = pc.counts.Count() - countBefore
+	result.Timings.FirstByte = firstRead.Sub(sent)
+	result.Timings.Transfer = time.Since(firstRead)
+	// A connection that is being closed because ctx was cancelled is not pooled
+	if stopClosing() && err == nil && resp.reusable && c.KeepAlive {
+		_ = pc.conn.SetDeadline(time.Time{})
+		c.pool.put(poolKey(req.url), pc)
+	} else {
+		pc.conn.Close()
+	}
+	return resp, err
+}
+
+// writeHead writes the status line and header fields of resp to writer in the form
+// they were received, followed by a blank line
+func writeHead(writer io.Writer, resp *response) {
+	// Buffered writer will noop after the first error, which there is no use in
+	// reporting while the response is still being read
+	buffered := bufio.NewWriter(writer)
+	_, _ = fmt.Fprintf(buffered, "%s\r\n", resp.statusLine)
+	for _, field := range resp.header {
+		_, _ = fmt.Fprintf(buffered, "%s: %s\r\n", field.Name, field.Value)
+	}
+	_, _ = fmt.Fprint(buffered, "\r\n")
+	_ = buffered.Flush()
+}
+
 // MakeHTTPRequest opens a TCP connection to the host specified in requestURL and
 // sends a single HTTP GET request corresponding to the request URI in requestURL
-// using a set of default HTTP headers and any headers passed by the caller. Header
-// values passed by the caller take precedence over defaults.
+// using a set of default HTTP headers and any headers passed by the caller. Headers
+// passed by the caller take precedence over defaults.
 //
 // The HTTP response body (omitting headers) is written to writer.
 // Returns the HTTP status code and the number of bytes read.
@@ -34,32 +427,92 @@ const statusLineRegex = `^(?:HTTP|http)/\d\.\d (\d{3}) (?:[\x21-\x7E\x80-\xFF][\
 // The caller can abort a request by passing an abort channel as an argument. The
 // request will be aborted after an optional timeout if a duration is written to
 // the abort channel or if the channel is closed.
-func MakeHTTPRequest(requestURL *url.URL, writer io.Writer, headers *map[string]string,
+func MakeHTTPRequest(requestURL *url.URL, writer io.Writer, headers Header,
 	abort chan time.Duration) (status int, bytesRead int, err error) {
 
-	// SendRequest closes conn
-	//var conn net.Conn
-	var tcpConn net.Conn
-	var conn net.Conn
-	tcpConn, err = net.Dial("tcp", requestURL.Host)
+	client := &Client{Headers: headers}
+	result, err := client.Do(requestURL, writer, abort)
+	return result.Status, result.BytesRead, err
+}
+
+// Dialer opens the connections that carry a Client's requests. Dial is passed the
+// host and port a connection is needed for, which the Dialer may ignore, and
+// records the time taken by any DNS lookup and by connecting in timings. It should
+// give up once ctx is done, which happens when the connect timeout expires.
+type Dialer interface {
+	Dial(ctx context.Context, address string, timings *PhaseTimings) (net.Conn, error)
+}
+
+// DialerFunc adapts an ordinary function to the Dialer interface
+type DialerFunc func(ctx context.Context, address string, timings *PhaseTimings) (net.Conn, error)
+
+// Dial calls f(ctx, address, timings)
+func (f DialerFunc) Dial(ctx context.Context, address string, timings *PhaseTimings) (
+	net.Conn, error) {
+
+	return f(ctx, address, timings)
+}
+
+// UnixDialer connects to the Unix domain socket at Path regardless of the address
+// requested, so that requests keep the Host header and request URI of their URL
+// while being sent to a local server such as a sidecar proxy
+type UnixDialer struct {
+	Path string
+}
+
+// Dial connects to the socket, recording the time taken as the connect time
+func (d UnixDialer) Dial(ctx context.Context, address string, timings *PhaseTimings) (
+	net.Conn, error) {
+
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", d.Path)
+	timings.Connect = time.Since(start)
+	return conn, err
+}
+
+// dialTimed opens a TCP connection to address, recording the time taken to look
+// up the host and to establish the connection in timings. If the host resolves
+// to several addresses they are tried in order until one accepts the connection
+// or ctx is done.
+func dialTimed(ctx context.Context, address string, timings *PhaseTimings) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	// Negotiate TLS if required
-	if requestURL.Scheme == "https" {
-		c := tls.Client(tcpConn,
-			&tls.Config{ServerName: requestURL.Hostname(), InsecureSkipVerify: true})
-		conn = net.Conn(c)
-	} else {
-		conn = tcpConn
+	addresses := []string{address}
+	if net.ParseIP(host) == nil {
+		start := time.Now()
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		timings.DNSLookup = time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+		addresses = addresses[:0]
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+		}
 	}
+	return dialAddresses(ctx, addresses, timings)
+}
 
-	err = SendRequest(conn, requestURL, headers)
-	if err != nil {
-		return
+// dialAddresses opens a TCP connection to the first of addresses that accepts one,
+// recording the time taken in timings
+func dialAddresses(ctx context.Context, addresses []string, timings *PhaseTimings) (
+	net.Conn, error) {
+
+	start := time.Now()
+	defer func() { timings.Connect = time.Since(start) }()
+	var dialer net.Dialer
+	var conn net.Conn
+	var err error
+	for _, addr := range addresses {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			break
+		}
 	}
-	return ReadResponse(conn, writer, abort)
+	return conn, err
 }
 
 // ParseFuzzyHTTPUrl parses a user supplied URL and attempts to use the http
@@ -105,111 +558,288 @@ func ParseFuzzyHTTPUrl(urlRaw string) (*url.URL, error) {
 // the response body to writer. The caller must send a valid HTTP request over conn
 // before passing it to ReadResponse.
 //
-// Reading from a TCP connection blocks the Go routine executing ReadResponse
-// until the server closes the connection. The caller can abort long reads at
-// any time (or never) by passing a timeout value over the abort channel.
-// If a timeout is received over abort, ReadResponse will close conn after the
-// specified timeout. Closing the abort channel closes conn immediately.
+// The end of the response body is determined by the Content-Length header or the
+// chunked transfer coding if the server uses either, otherwise the body is read
+// until the server closes the connection. Reading from a TCP connection blocks the
+// Go routine executing ReadResponse until the response is complete. The caller can
+// abort long reads at any time (or never) by passing a timeout value over the
+// abort channel. If a timeout is received over abort, ReadResponse will close conn
+// after the specified timeout. Closing the abort channel closes conn immediately.
+// ReadResponse always closes conn before returning.
 //
-// Returns the HTTP status code of the response and the number of bytes read
-// from the response including headers.
+// Returns the HTTP status code and header fields of the response in the order they
+// were received, and the number of bytes read from the response including headers.
 func ReadResponse(conn net.Conn, writer io.Writer, abort chan time.Duration) (
-	status int, bytesRead int, retErr error) {
+	status int, header Header, bytesRead int, retErr error) {
 
 	defer conn.Close()
-	// Close the socket to unblock read if the caller decides to abort the request
-	if abort != nil {
-		cleanupChan := make(chan struct{})
-		defer close(cleanupChan)
-		go func() {
-			select {
-			case gracePeriod, ok := <-abort:
-				if ok {
-					// Give the connection a small amount of time to finish up
-					timeout := time.NewTimer(gracePeriod)
-					<-timeout.C
-				}
-				conn.Close()
-			case <-cleanupChan:
-				// Avoid leaking the Go routine if no signal is received
-			}
-		}()
-	}
-
 	// Count the number of bytes read by wrapping the connection in a counter.Reader
 	counts := counter.NewReader(conn)
 	defer func() { bytesRead = counts.Count() }()
-
 	reader := bufio.NewReaderSize(counts, os.Getpagesize()*16)
+	resp, retErr := readResponse(conn, reader, func(*response) io.Writer { return writer },
+		abort, false, false)
+	status, header = resp.status, resp.header
+	return
+}
+
+// response holds the parts of an HTTP response parsed by readResponse
+type response struct {
+	statusLine string
+	status     int
+	header     Header
+	// Number of body bytes written after removing any content coding
+	bodyBytes int64
+	// Trailer fields sent after a chunked response body
+	trailer textproto.MIMEHeader
+	// Whether the connection can be used to send another request
+	reusable bool
+}
+
+// readResponse reads an HTTP response from reader, which must read from conn, and
+// writes the response body to the writer returned by bodyWriter once the status
+// line and headers have been read. Unlike ReadResponse it does not close conn.
+// Abort is handled as described by ReadResponse. Responses to HEAD requests never
+// have a body, so the caller must set head if the request used the HEAD method. If
+// decode is set any content coding listed in the Content-Encoding header is removed
+// from the body before it is written.
+func readResponse(conn net.Conn, reader *bufio.Reader, bodyWriter func(*response) io.Writer,
+	abort chan time.Duration, head, decode bool) (resp response, retErr error) {
+
+	stopWatching := closeOnAbort(conn, abort)
+	defer stopWatching()
+
 	tp := textproto.NewReader(reader)
 	// Parse the Status-Line; response code is the second field
 	// See https://www.w3.org/Protocols/rfc2616/rfc2616-sec6.html
 	statusLineRegex := regexp.MustCompile(statusLineRegex)
-	// Continue waiting for final status if interim status 100 is received
-	// See: https://tools.ietf.org/html/rfc2616#section-10.1.1
+	// Continue waiting for final status while interim 1xx responses are received,
+	// except for 101, which switches the connection to another protocol and is
+	// only sent in answer to an Upgrade request
+	// See https://tools.ietf.org/html/rfc7231#section-6.2
+	statusLine, err := tp.ReadLine()
 	for {
-		statusLine, err := tp.ReadLine()
 		if err != nil {
 			retErr = err
 			return
 		}
 		slMatch := statusLineRegex.FindStringSubmatch(statusLine)
 		if slMatch == nil {
-			retErr = errors.New(fmt.Sprintf("bad status line: %s\n", statusLine))
+			retErr = &ProtocolError{Reason: fmt.Sprintf("bad status line %q", statusLine)}
 			return
 		}
-		status, _ = strconv.Atoi(slMatch[1])
-		if status != 100 {
+		resp.status, _ = strconv.Atoi(slMatch[1])
+		if resp.status == 101 {
+			retErr = &ProtocolError{Reason: fmt.Sprintf("unexpected status line %q", statusLine)}
+			return
+		}
+		if resp.status/100 != 1 {
 			break
 		}
+		// Skip the header fields of the interim response. Some servers omit them
+		// along with the blank line that should end them.
+		for {
+			statusLine, err = tp.ReadLine()
+			if err != nil || statusLineRegex.MatchString(statusLine) {
+				break
+			}
+			if statusLine == "" {
+				statusLine, err = tp.ReadLine()
+				break
+			}
+		}
 	}
-	// Skip over the headers without writing them to writer
-	for {
-		line, err := tp.ReadLine()
-		if err != nil {
-			retErr = err
+	resp.statusLine = statusLine
+	resp.header, err = readHeader(tp)
+	if err != nil {
+		retErr = err
+		return
+	}
+	header := resp.header
+
+	// HTTP/1.1 connections persist unless either side asks to close them, while
+	// HTTP/1.0 connections close unless both sides ask to keep them alive
+	// See https://tools.ietf.org/html/rfc7230#section-6.3
+	if strings.HasPrefix(strings.ToUpper(resp.statusLine), "HTTP/1.0") {
+		resp.reusable = header.hasToken("Connection", "keep-alive")
+	} else {
+		resp.reusable = !header.hasToken("Connection", "close")
+	}
+
+	// Determine the length of the response body
+	// See https://tools.ietf.org/html/rfc7230#section-3.3.3
+	var body io.Reader
+	var chunked *chunkedReader
+	noBody := head || resp.status == 204 || resp.status == 304
+	if noBody {
+		body = strings.NewReader("")
+	} else if strings.Contains(strings.ToLower(header.Get("Transfer-Encoding")), "chunked") {
+		chunked = newChunkedReader(reader)
+		body = chunked
+	} else if cl := header.Get("Content-Length"); cl != "" {
+		length, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || length < 0 {
+			retErr = &ProtocolError{Reason: fmt.Sprintf("bad Content-Length %q", cl)}
 			return
 		}
-		if line == "" {
-			break
+		body = &exactReader{reader: io.LimitReader(reader, length), remaining: length}
+	} else {
+		// Without framing the body ends when the server closes the connection
+		body = reader
+		resp.reusable = false
+	}
+
+	// The head is written even if the body cannot be decoded
+	writer := bodyWriter(&resp)
+	decoded := body
+	if encoding := header.Get("Content-Encoding"); decode && encoding != "" && !noBody {
+		// An empty body has nothing to decode, whatever its Content-Encoding says.
+		// Errors reading the body are left for the copy below to report.
+		buffered := bufio.NewReader(body)
+		body, decoded = buffered, buffered
+		if _, peekErr := buffered.Peek(1); peekErr == nil {
+			decoded, err = newContentDecoder(buffered, encoding)
+			if err != nil {
+				retErr = err
+				resp.reusable = false
+				return
+			}
 		}
 	}
 
 	// Write the response body to writer
-	_, err := reader.WriteTo(writer)
+	resp.bodyBytes, err = io.Copy(writer, decoded)
+	if err == nil && decoded != body {
+		// Consume anything following the compressed data to keep the framing intact
+		_, err = io.Copy(ioutil.Discard, body)
+	}
 	if err != nil && err != io.EOF {
 		retErr = err
+		resp.reusable = false
 		return
 	}
+	if chunked != nil {
+		resp.trailer = chunked.Trailer
+	}
 	return
 }
 
-// SendRequest sends a HTTP GET request corresponding to the request URI in requestURL
-// to conn using a set of default HTTP headers and any headers passed by the caller.
-// Header values passed by the caller take precedence over defaults. By default the
-// server is instructed to close the connection after sending its response.
-func SendRequest(conn net.Conn, requestURL *url.URL, headers *map[string]string) error {
-	reqHeaders := map[string]string{
-		"Host":            requestURL.Host,
-		"User-Agent":      "Mozilla/5.0",
-		"Accept":          "*/*",
-		"Accept-Encoding": "identity",
-		"Connection":      "close",
+// abortContext returns a context that is cancelled if the caller decides to abort
+// the request, as described by Do, until the returned function is called. A nil
+// abort channel is never watched.
+func abortContext(abort chan time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if abort == nil {
+		return ctx, cancel
 	}
-	// The caller is reasonable for providing reasonable headers if they override defaults
-	if headers != nil {
-		for k, v := range *headers {
-			reqHeaders[k] = v
+	go func() {
+		select {
+		case gracePeriod, ok := <-abort:
+			if ok {
+				// Give the request a small amount of time to finish up
+				timeout := time.NewTimer(gracePeriod)
+				defer timeout.Stop()
+				select {
+				case <-timeout.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			cancel()
+		case <-ctx.Done():
+			// Avoid leaking the Go routine if no signal is received
+		}
+	}()
+	return ctx, cancel
+}
+
+// isAbort reports whether err may have been caused by aborting a request, which
+// closes its connection or cancels its context
+func isAbort(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, context.Canceled)
+}
+
+// closeOnAbort closes conn to unblock reads and writes if the caller decides to
+// abort the request, as described by ReadResponse, until the returned function is
+// called. A nil abort channel is never watched.
+func closeOnAbort(conn net.Conn, abort chan time.Duration) func() {
+	if abort == nil {
+		return func() {}
+	}
+	cleanupChan := make(chan struct{})
+	go func() {
+		select {
+		case gracePeriod, ok := <-abort:
+			if ok {
+				// Give the connection a small amount of time to finish up
+				timeout := time.NewTimer(gracePeriod)
+				defer timeout.Stop()
+				select {
+				case <-timeout.C:
+				case <-cleanupChan:
+					return
+				}
+			}
+			conn.Close()
+		case <-cleanupChan:
+			// Avoid leaking the Go routine if no signal is received
 		}
+	}()
+	return func() { close(cleanupChan) }
+}
+
+// exactReader reads exactly remaining bytes from reader, returning
+// io.ErrUnexpectedEOF if reader ends early
+type exactReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (er *exactReader) Read(buf []byte) (n int, err error) {
+	n, err = er.reader.Read(buf)
+	er.remaining -= int64(n)
+	if err == io.EOF && er.remaining > 0 {
+		err = io.ErrUnexpectedEOF
 	}
+	return
+}
+
+// SendRequest sends a HTTP request using method corresponding to the request URI in
+// requestURL to conn using a set of default HTTP headers and any headers passed by
+// the caller. Headers passed by the caller replace any defaults with the same name
+// and are sent in the order given, including repeated names. By default the server
+// is instructed to close the connection after sending its response.
+//
+// If body is not nil it is sent after the headers and the Content-Length header is
+// set to its length. Content-Length is also set to zero for methods that usually
+// carry a body when body is nil.
+func SendRequest(conn net.Conn, method string, requestURL *url.URL, headers Header,
+	body RequestBody) error {
+
+	return writeRequest(conn, method, requestURL.RequestURI(), requestURL, headers, body)
+}
+
+// writeRequest implements SendRequest using target as the request target, which is
+// the absolute URL instead of the request URI when sending requests to a proxy
+func writeRequest(conn net.Conn, method string, target string, requestURL *url.URL,
+	headers Header, body RequestBody) error {
+
+	reqHeaders := requestHeaders(method, requestURL, headers, body)
 	// Write HTTP request line and headers. Buffered writer will noop after the
 	// first error so we only need to check err on the final Flush()
 	writer := bufio.NewWriter(conn)
-	_, _ = fmt.Fprintf(writer, "GET %s HTTP/1.1\r\n", requestURL.RequestURI())
-	for header, value := range reqHeaders {
-		_, _ = fmt.Fprintf(writer, "%s: %s\r\n", header, value)
+	_, _ = fmt.Fprintf(writer, "%s %s HTTP/1.1\r\n", method, target)
+	for _, field := range reqHeaders {
+		_, _ = fmt.Fprintf(writer, "%s: %s\r\n", field.Name, field.Value)
 	}
 	_, _ = fmt.Fprint(writer, "\r\n")
+	if body != nil {
+		err := writeBody(writer, body)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
 	err := writer.Flush()
 	if err != nil {
 		conn.Close()
@@ -217,3 +847,50 @@ func SendRequest(conn net.Conn, requestURL *url.URL, headers *map[string]string)
 	}
 	return nil
 }
+
+// requestHeaders merges the default headers for a request with the headers passed
+// to SendRequest by the caller
+func requestHeaders(method string, requestURL *url.URL, headers Header,
+	body RequestBody) Header {
+
+	defaults := Header{
+		{"Host", requestURL.Host},
+		{"User-Agent", "Mozilla/5.0"},
+		{"Accept", "*/*"},
+		{"Accept-Encoding", "identity"},
+		{"Connection", "close"},
+	}
+	if body != nil {
+		defaults.Add("Content-Length", strconv.FormatInt(body.Len(), 10))
+	} else if method == "POST" || method == "PUT" || method == "PATCH" {
+		defaults.Add("Content-Length", "0")
+	}
+	// Defaults are sent first unless the caller overrides them, followed by the
+	// caller's headers in order. The caller is reasonable for providing reasonable
+	// headers if they override defaults.
+	reqHeaders := make(Header, 0, len(defaults)+len(headers))
+	for _, field := range defaults {
+		if !headers.Has(field.Name) {
+			reqHeaders = append(reqHeaders, field)
+		}
+	}
+	return append(reqHeaders, headers...)
+}
+
+// writeBody copies a fresh copy of body to writer, checking that its length
+// matches the Content-Length sent with the request
+func writeBody(writer io.Writer, body RequestBody) error {
+	reader, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	n, err := io.Copy(writer, reader)
+	if err != nil {
+		return err
+	}
+	if n != body.Len() {
+		return fmt.Errorf("request body length changed: expected %d bytes, read %d", body.Len(), n)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"jockey/counter"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are connection specific header fields that HTTP/2 does not allow
+// See https://tools.ietf.org/html/rfc7540#section-8.1.2.2
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// http2Transport returns the transport used for HTTP/2 requests, creating it on
+// first use. Unlike HTTP/1.1, which Jockey speaks itself, HTTP/2 requests are
+// sent using the net/http implementation, which negotiates h2 using ALPN for
+// https and uses h2c with prior knowledge for http.
+func (c *Client) http2Transport() *http.Transport {
+	c.h2Once.Do(func() {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		c.h2 = &http.Transport{
+			DialContext:        c.dialContext,
+			Protocols:          protocols,
+			TLSClientConfig:    c.TLSConfig,
+			DisableCompression: true,
+			// Connect timeouts are applied by dialContext
+			TLSHandshakeTimeout:   c.TLSTimeout,
+			ResponseHeaderTimeout: c.FirstByteTimeout,
+		}
+	})
+	return c.h2
+}
+
+// sendHTTP2 sends a single request over an HTTP/2 stream, reusing an established
+// connection to the host if there is one, and records the outcome in result.
+// Streams may share a connection with requests sent concurrently by other callers.
+//
+// The time taken to open a tunnel through a proxy is not measured separately.
+// BytesRead counts only the bytes of the response body as sent by the server, since
+// the frames carrying the headers of a stream cannot be told apart from those of
+// other streams.
+//
+// The stream is reset if ctx is cancelled.
+func (c *Client) sendHTTP2(ctx context.Context, req request,
+	bodyWriter func(*response) io.Writer, result *Result) (response, error) {
+
+	ctx, cancel := c.limit("total", 0, req.deadline).context(ctx)
+	defer cancel()
+
+	// The transport may report on a connection it is still dialing after the
+	// request has been cancelled, so the trace guards everything it records
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart, sent, firstByte time.Time
+	var handshakeErr error
+	var connected, gotConn bool
+	timings := &result.Timings
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			timings.DNSLookup = time.Since(dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			// Each address the host resolves to is tried in turn
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			timings.Connect = time.Since(connectStart)
+			connected = err == nil
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			timings.TLSHandshake = time.Since(tlsStart)
+			if state.DidResume {
+				timings.ResumedTLSHandshake = timings.TLSHandshake
+			}
+			handshakeErr = err
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			gotConn = true
+			if info.Reused {
+				result.ConnectionsReused++
+			} else {
+				result.ConnectionsOpened++
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			firstByte = time.Now()
+		},
+	}
+
+	httpReq, err := c.newHTTP2Request(httptrace.WithClientTrace(ctx, trace), req)
+	if err != nil {
+		return response{}, err
+	}
+	httpResp, err := c.http2Transport().RoundTrip(httpReq)
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		var timeoutErr *TimeoutError
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			return response{}, &TimeoutError{Phase: "total", Limit: c.Timeout, Err: err}
+		case errors.As(err, &timeoutErr):
+			// Reported by dialContext
+			return response{}, timeoutErr
+		case !isTimeout(err):
+		case !connected && !gotConn:
+			return response{}, &TimeoutError{Phase: "connect", Limit: c.ConnectTimeout, Err: err}
+		case !gotConn:
+			return response{}, &TimeoutError{Phase: "TLS", Limit: c.TLSTimeout, Err: err}
+		default:
+			return response{}, &TimeoutError{Phase: "first byte", Limit: c.FirstByteTimeout,
+				Err: err}
+		}
+		if handshakeErr != nil {
+			return response{}, newTLSHandshakeError(err)
+		}
+		return response{}, err
+	}
+	defer httpResp.Body.Close()
+	resp := response{
+		statusLine: httpResp.Proto + " " + httpResp.Status,
+		status:     httpResp.StatusCode,
+		header:     sortedHeader(httpResp.Header),
+	}
+	result.Status = resp.status
+	result.Header = resp.header
+	result.TLS = httpResp.TLS
+
+	// The head is written even if the body cannot be decoded
+	writer := bodyWriter(&resp)
+	counts := counter.NewReader(httpResp.Body)
+	body := io.Reader(counts)
+	if encoding := httpResp.Header.Get("Content-Encoding"); c.Compressed && encoding != "" &&
+		req.method != "HEAD" {
+		// An empty body has nothing to decode, whatever its Content-Encoding says
+		buffered := bufio.NewReader(counts)
+		body = buffered
+		if _, peekErr := buffered.Peek(1); peekErr == nil {
+			body, err = newContentDecoder(buffered, encoding)
+		}
+	}
+	if err == nil {
+		resp.bodyBytes, err = io.Copy(writer, body)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = &TimeoutError{Phase: "total", Limit: c.Timeout, Err: err}
+		}
+	}
+	end := time.Now()
+	result.BytesRead = counts.Count()
+	result.BodyBytes = int(resp.bodyBytes)
+	if len(httpResp.Trailer) > 0 {
+		resp.trailer = textproto.MIMEHeader(httpResp.Trailer)
+		result.Trailer = resp.trailer
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !firstByte.IsZero() {
+		timings.FirstByte = firstByte.Sub(sent)
+		timings.Transfer = end.Sub(firstByte)
+		timings.Stream = end.Sub(sent)
+	}
+	return resp, err
+}
+
+// newHTTP2Request builds the net/http request corresponding to req. The headers
+// match those sent by SendRequest except for connection specific headers, which
+// HTTP/2 does not allow.
+func (c *Client) newHTTP2Request(ctx context.Context, req request) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, req.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range requestHeaders(req.method, req.url, c.headers(req), req.body) {
+		name := textproto.CanonicalMIMEHeaderKey(field.Name)
+		switch {
+		case hopHeaders[name]:
+		case name == "Host":
+			httpReq.Host = field.Value
+		case name == "Content-Length":
+			// The transport sends Content-Length based on the body
+		default:
+			httpReq.Header.Add(name, field.Value)
+		}
+	}
+	if req.body != nil {
+		httpReq.ContentLength = req.body.Len()
+		httpReq.GetBody = req.body.Open
+		httpReq.Body, err = req.body.Open()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return httpReq, nil
+}
+
+// sortedHeader converts header to a Header sorted by name. HTTP/2 header names are
+// always lower case, so unlike HTTP/1.1 the original case cannot be preserved.
+func sortedHeader(header http.Header) Header {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sorted Header
+	for _, name := range names {
+		for _, value := range header[name] {
+			sorted.Add(strings.ToLower(name), value)
+		}
+	}
+	return sorted
+}
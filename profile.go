@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"jockey/histogram"
 	"jockey/quickselect"
 	"math"
 	"math/rand"
@@ -10,7 +13,10 @@ import (
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 )
@@ -20,6 +26,49 @@ import (
 const HTTPErrorStart = 400
 const gracefulCleanupTimeout = time.Second / 2
 
+// Rate-scheduled profiles count requests sent more than lateThreshold after their
+// scheduled time as late, and allow at most defaultMaxInFlight outstanding
+// requests unless the caller specifies a different cap.
+const lateThreshold = time.Millisecond
+const defaultMaxInFlight = 1000
+
+// Request times are recorded in a histogram covering this range with this many
+// significant digits unless LatencyOptions say otherwise
+const defaultLowestLatency = time.Microsecond
+const defaultHighestLatency = time.Hour
+const defaultLatencyDigits = 3
+
+// LatencyOptions controls how ProfileResults records request and phase times. By
+// default they are recorded in histograms, so percentiles are approximate but
+// memory use does not grow with the number of requests. Zero values use the
+// defaults.
+type LatencyOptions struct {
+	// Request times from Lowest to Highest are recorded with SignificantDigits
+	// significant decimal digits; see histogram.New for the valid values. Times
+	// above Highest are recorded as Highest, although Slowest stays exact.
+	Lowest            time.Duration
+	Highest           time.Duration
+	SignificantDigits int
+	// Exact keeps every request time so that percentiles are exact, at the cost
+	// of memory in proportion to the number of requests
+	Exact bool
+}
+
+// histogram returns an empty histogram for the options
+func (opts LatencyOptions) histogram() *histogram.Histogram {
+	lowest, highest, digits := opts.Lowest, opts.Highest, opts.SignificantDigits
+	if lowest == 0 {
+		lowest = defaultLowestLatency
+	}
+	if highest == 0 {
+		highest = defaultHighestLatency
+	}
+	if digits == 0 {
+		digits = defaultLatencyDigits
+	}
+	return histogram.New(int64(lowest), int64(highest), digits)
+}
+
 // ProfileResults stores the results of the current profile run
 type ProfileResults struct {
 	Requests              int
@@ -30,18 +79,115 @@ type ProfileResults struct {
 	SmallestResponseBytes int
 	LargestResponseBytes  int
 	StatusCodeCounts      map[int]int
-	// Median should be accessed through GetMedian since updating it is an O(n) operation
+	// Number of requests that failed without a valid HTTP response by cause, and
+	// the message of the first error seen in each class
+	ErrorClassCounts map[ErrorClass]int
+	ErrorExamples    map[ErrorClass]string
+	// Total size of successful responses including headers as read from the
+	// connection, and of their bodies after removing any content coding
+	BytesRead    int64
+	DecodedBytes int64
+	// Number of connections opened and reused over the course of the profile
+	ConnectionsOpened int
+	ConnectionsReused int
+	// Wall clock times at which the profile started and finished
+	StartTime time.Time
+	EndTime   time.Time
+	// Percentiles lists the request time percentiles included in String
+	Percentiles []float64
+	// Latency controls how request times are recorded and must be set before Init
+	Latency LatencyOptions
+	// Timings for each phase of successful requests; see PhaseTimings
+	DNSLookup    PhaseStats
+	Connect      PhaseStats
+	ProxyConnect PhaseStats
+	TLSHandshake PhaseStats
+	FirstByte    PhaseStats
+	Transfer     PhaseStats
+	Stream       PhaseStats
+	// TLS handshakes split by whether they resumed an earlier session. They are
+	// only included in String when CompareHandshakes is set.
+	FullHandshake     PhaseStats
+	ResumedHandshake  PhaseStats
+	CompareHandshakes bool
+	// Hops holds the total time taken by each request in a chain of redirects,
+	// indexed by its position in the chain. It is only recorded when redirects
+	// are followed and only reported once at least one redirect was followed.
+	Hops []PhaseStats
+	// Only used by rate-scheduled profiles; TargetRate is in requests per second
+	TargetRate      float64
+	LateRequests    int
+	DroppedRequests int
+	// Request times are always recorded in latencies, and also in requestTimes if
+	// Latency.Exact is set. The median should be accessed through GetMedian since
+	// updating it from requestTimes is an O(n) operation.
+	latencies     *histogram.Histogram
 	requestTimes  []time.Duration
 	medianTime    time.Duration
 	medianCurrent bool // Avoid re-calculating if the median is up-to-date
 }
 
-// Init initializes a new ProfileResults struct
+// PhaseStats accumulates the times recorded for a single phase of a request. Like
+// the request times in ProfileResults, phase times are recorded in a histogram
+// unless the latency options set Exact. The zero value uses the default options.
+type PhaseStats struct {
+	Count int
+	Mean  float64 // Float to minimize precision loss since we update on each request
+	Max   time.Duration
+	// The histogram is created on the first call to Add so that phases which
+	// never happen cost no memory
+	latency   LatencyOptions
+	latencies *histogram.Histogram
+	times     []time.Duration
+}
+
+// Add records the time taken by one request to complete the phase
+func (ps *PhaseStats) Add(phaseTime time.Duration) {
+	if ps.latencies == nil {
+		ps.latencies = ps.latency.histogram()
+	}
+	ps.Count++
+	ps.latencies.Record(int64(phaseTime))
+	if ps.latency.Exact {
+		ps.times = append(ps.times, phaseTime)
+	}
+	ps.Mean += (float64(phaseTime) - ps.Mean) / float64(ps.Count)
+	if phaseTime > ps.Max {
+		ps.Max = phaseTime
+	}
+}
+
+// Median returns the median time recorded for the phase. Unless the latency
+// options set Exact it is read from a histogram, as in ProfileResults.GetMedian;
+// otherwise it is calculated in O(n) time.
+func (ps *PhaseStats) Median() time.Duration {
+	if !ps.latency.Exact {
+		if ps.latencies == nil {
+			return 0
+		}
+		return time.Duration(ps.latencies.ValueAtPercentile(50))
+	}
+	median, _ := quickselect.Median(ps.times)
+	return median
+}
+
+// Init initializes a new ProfileResults struct. It panics if pr.Latency is not
+// valid.
 func (pr *ProfileResults) Init(numExpectedRequests int) {
 	// Seed the random number generator for calculating the median later
 	rand.Seed(time.Now().UnixNano())
 	pr.StatusCodeCounts = make(map[int]int)
-	pr.requestTimes = make([]time.Duration, 0, numExpectedRequests)
+	pr.ErrorClassCounts = make(map[ErrorClass]int)
+	pr.ErrorExamples = make(map[ErrorClass]string)
+	pr.latencies = pr.Latency.histogram()
+	if pr.Latency.Exact {
+		pr.requestTimes = make([]time.Duration, 0, numExpectedRequests)
+	}
+	for _, stats := range []*PhaseStats{&pr.DNSLookup, &pr.Connect, &pr.ProxyConnect,
+		&pr.TLSHandshake, &pr.FirstByte, &pr.Transfer, &pr.Stream,
+		&pr.FullHandshake, &pr.ResumedHandshake} {
+		*stats = PhaseStats{latency: pr.Latency}
+	}
 	pr.Fastest = math.MaxInt64
 	pr.SmallestResponseBytes = math.MaxInt32
 }
@@ -66,8 +212,21 @@ func (pr *ProfileResults) String() string {
 	_, _ = fmt.Fprintf(writer, "Slowest request:\t%15v\tms\n", pr.Slowest.Milliseconds())
 	_, _ = fmt.Fprintf(writer, "Mean time:\t%15v\tms\n", time.Duration(pr.MeanTime).Milliseconds())
 	_, _ = fmt.Fprintf(writer, "Median time:\t%15v\tms\n", pr.GetMedian().Milliseconds())
+	for _, p := range pr.Percentiles {
+		_, _ = fmt.Fprintf(writer, "p%s time:\t%15v\tms\n",
+			strconv.FormatFloat(p, 'f', -1, 64), pr.GetPercentile(p).Milliseconds())
+	}
 	_, _ = fmt.Fprintf(writer, "Smallest response:\t%15v\tbytes\n", pr.SmallestResponseBytes)
 	_, _ = fmt.Fprintf(writer, "Largest response:\t%15v\tbytes\n", pr.LargestResponseBytes)
+	_, _ = fmt.Fprintf(writer, "Bytes read:\t%15v\tbytes\n", pr.BytesRead)
+	_, _ = fmt.Fprintf(writer, "Body bytes decoded:\t%15v\tbytes\n", pr.DecodedBytes)
+	_, _ = fmt.Fprintf(writer, "Connections opened:\t%15v\n", pr.ConnectionsOpened)
+	_, _ = fmt.Fprintf(writer, "Connections reused:\t%15v\n", pr.ConnectionsReused)
+	if pr.TargetRate > 0 {
+		_, _ = fmt.Fprintf(writer, "Target rate:\t%15.2f\treq/s\n", pr.TargetRate)
+		_, _ = fmt.Fprintf(writer, "Late requests:\t%15v\n", pr.LateRequests)
+		_, _ = fmt.Fprintf(writer, "Dropped requests:\t%15v\n", pr.DroppedRequests)
+	}
 
 	statusCodes := make([]int, 0, len(pr.StatusCodeCounts))
 	for code := range pr.StatusCodeCounts {
@@ -82,23 +241,113 @@ func (pr *ProfileResults) String() string {
 			_, _ = fmt.Fprintf(writer, "%d:\t%15v\n", code, pr.StatusCodeCounts[code])
 		}
 	}
+	errorClasses := make([]string, 0, len(pr.ErrorClassCounts))
+	for class := range pr.ErrorClassCounts {
+		errorClasses = append(errorClasses, string(class))
+	}
+	sort.Strings(errorClasses)
+	if len(errorClasses) > 0 {
+		_, _ = fmt.Fprintf(writer, "Failed without response:\t\n")
+		for _, class := range errorClasses {
+			_, _ = fmt.Fprintf(writer, "%s:\t%15v\t%s\n", class, pr.ErrorClassCounts[ErrorClass(class)],
+				pr.ErrorExamples[ErrorClass(class)])
+		}
+	}
+	_ = writer.Flush()
+
+	// Break request times down by phase, omitting phases that never happened
+	writer = tabwriter.NewWriter(&resultsBuilder, minWidth, tabWidth, padding, padChar, flags)
+	_, _ = fmt.Fprintf(writer, "Phase:\t%10s\t%10s\t%10s\n", "Mean", "Median", "Max")
+	for _, phase := range pr.phases() {
+		if phase.stats.Count == 0 {
+			continue
+		}
+		_, _ = fmt.Fprintf(writer, "%s:\t%10.3f\t%10.3f\t%10.3f\tms\n", phase.name,
+			milliseconds(time.Duration(phase.stats.Mean)), milliseconds(phase.stats.Median()),
+			milliseconds(phase.stats.Max))
+	}
 	_ = writer.Flush()
 	return resultsBuilder.String()
 }
 
-// GetMedian gets the median response time from the current set of test results
-// Quick select is used to determine the median since it runs in O(n) time and
-// Jockey only calculates the median once per run. If Jockey needed to calculate
-// the median more than once this function could be implemented using two priority
-// queues which would require O(n log n) overall but would allow the median to be
-// updated after each run in O(log n) time.
+// namedPhase pairs the statistics for a phase with its display name and the key
+// used to identify it in a ProfileReport
+type namedPhase struct {
+	name  string
+	key   string
+	stats *PhaseStats
+}
+
+// phases returns the statistics for each phase in the order requests go through them
+func (pr *ProfileResults) phases() []namedPhase {
+	phases := []namedPhase{
+		{"DNS lookup", "dns_lookup", &pr.DNSLookup},
+		{"TCP connect", "connect", &pr.Connect},
+		{"Proxy connect", "proxy_connect", &pr.ProxyConnect},
+		{"TLS handshake", "tls_handshake", &pr.TLSHandshake},
+	}
+	if pr.CompareHandshakes {
+		phases = append(phases,
+			namedPhase{"  Full", "tls_full_handshake", &pr.FullHandshake},
+			namedPhase{"  Resumed", "tls_resumed_handshake", &pr.ResumedHandshake})
+	}
+	phases = append(phases,
+		namedPhase{"First byte", "first_byte", &pr.FirstByte},
+		namedPhase{"Transfer", "transfer", &pr.Transfer},
+		namedPhase{"HTTP/2 stream", "stream", &pr.Stream})
+	if len(pr.Hops) > 1 {
+		for i := range pr.Hops {
+			phases = append(phases, namedPhase{
+				fmt.Sprintf("Hop %d", i+1), fmt.Sprintf("hop_%d", i+1), &pr.Hops[i]})
+		}
+	}
+	return phases
+}
+
+// milliseconds converts d to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// GetMedian gets the median response time from the current set of test results.
+// Unless Latency.Exact is set the median is read from a histogram in constant time
+// and is accurate to its significant digits, like GetPercentile(50).
+// Otherwise quick select is used to determine the exact median since it runs in
+// O(n) time and Jockey only calculates the median once per run. If Jockey needed to
+// calculate the median more than once this function could be implemented using
+// two priority queues which would require O(n log n) overall but would allow the
+// median to be updated after each run in O(log n) time.
 func (pr *ProfileResults) GetMedian() time.Duration {
+	if !pr.Latency.Exact {
+		return pr.GetPercentile(50)
+	}
 	if pr.medianCurrent || len(pr.requestTimes) == 0 {
 		return pr.medianTime
 	}
-	median, _ := quickselect.Median(pr.requestTimes)
+	pr.medianTime, _ = quickselect.Median(pr.requestTimes)
 	pr.medianCurrent = true
-	return median
+	return pr.medianTime
+}
+
+// GetPercentile gets the response time at percentile p, where 0 < p <= 100, from
+// the current set of test results using the nearest-rank method. The result is
+// the smallest recorded time such that at least p percent of request times are
+// less than or equal to it. Unless Latency.Exact is set the result is read from a
+// histogram and may be larger than the exact time by up to the precision of the
+// histogram. Otherwise, like GetMedian, each call runs in O(n) time.
+func (pr *ProfileResults) GetPercentile(p float64) time.Duration {
+	if !pr.Latency.Exact {
+		return time.Duration(pr.latencies.ValueAtPercentile(p))
+	}
+	if len(pr.requestTimes) == 0 || p <= 0 || p > 100 {
+		return 0
+	}
+	k := int(math.Ceil(p / 100 * float64(len(pr.requestTimes))))
+	if k < 1 {
+		k = 1
+	}
+	percentile, _ := quickselect.QuickSelect(pr.requestTimes, k)
+	return percentile
 }
 
 // UpdateStats updates the profile results to incorporate the results of a single test
@@ -108,12 +357,15 @@ func (pr *ProfileResults) UpdateStats(status int, requestTime time.Duration,
 	bytesTransferred int) {
 	pr.Requests++
 	// The mean request time can be updated in O(1) time on each result
-	// Add the request to pr.requestTimes first since we take the length in
-	// order to calculate the mean using only requests with an associated
-	// time (excluding requests that failed without a status code).
-	pr.requestTimes = append(pr.requestTimes, requestTime)
+	// Record the request time first since we take the count in order to
+	// calculate the mean using only requests with an associated time
+	// (excluding requests that failed without a status code).
+	pr.latencies.Record(int64(requestTime))
+	if pr.Latency.Exact {
+		pr.requestTimes = append(pr.requestTimes, requestTime)
+	}
 	delta := float64(requestTime) - pr.MeanTime
-	pr.MeanTime += delta / float64(len(pr.requestTimes))
+	pr.MeanTime += delta / float64(pr.latencies.Count())
 
 	// Update Slowest / Fastest response
 	if requestTime > pr.Slowest {
@@ -129,7 +381,7 @@ func (pr *ProfileResults) UpdateStats(status int, requestTime time.Duration,
 	if bytesTransferred < pr.SmallestResponseBytes {
 		pr.SmallestResponseBytes = bytesTransferred
 	}
-	// Need to store all times to calculate median...
+	// The exact median needs to be recalculated from all times
 	pr.medianCurrent = false
 
 	if _, ok := pr.StatusCodeCounts[status]; ok {
@@ -142,53 +394,333 @@ func (pr *ProfileResults) UpdateStats(status int, requestTime time.Duration,
 	}
 }
 
+// RecordHops adds the time taken by each request in a chain of redirects to the
+// profile results
+func (pr *ProfileResults) RecordHops(hops []Hop) {
+	for i, hop := range hops {
+		if i == len(pr.Hops) {
+			pr.Hops = append(pr.Hops, PhaseStats{latency: pr.Latency})
+		}
+		pr.Hops[i].Add(hop.Elapsed)
+	}
+}
+
+// RecordTimings adds the phase timings of a single successful request to the
+// profile results. Phases that were skipped by the request are not recorded.
+func (pr *ProfileResults) RecordTimings(timings PhaseTimings) {
+	phases := []struct {
+		stats *PhaseStats
+		time  time.Duration
+	}{
+		{&pr.DNSLookup, timings.DNSLookup},
+		{&pr.Connect, timings.Connect},
+		{&pr.ProxyConnect, timings.ProxyConnect},
+		{&pr.TLSHandshake, timings.TLSHandshake},
+		{&pr.FirstByte, timings.FirstByte},
+		{&pr.Transfer, timings.Transfer},
+		{&pr.Stream, timings.Stream},
+	}
+	for _, phase := range phases {
+		if phase.time > 0 {
+			phase.stats.Add(phase.time)
+		}
+	}
+	// A redirected request may have performed both kinds of handshake
+	if full := timings.TLSHandshake - timings.ResumedTLSHandshake; full > 0 {
+		pr.FullHandshake.Add(full)
+	}
+	if timings.ResumedTLSHandshake > 0 {
+		pr.ResumedHandshake.Add(timings.ResumedTLSHandshake)
+	}
+}
+
 // RecordFailedTransaction records an attempted request that result in an error
 // without receiving a valid HTTP response, such as a broken pipe, refused connection
-// or malformed HTTP response.
-func (pr *ProfileResults) RecordFailedTransaction() {
+// or malformed HTTP response. The failure is counted against the class of err,
+// and err is kept as an example if it is the first of its class.
+func (pr *ProfileResults) RecordFailedTransaction(err error) {
 	pr.Requests++
 	pr.FailedRequests++
+	class := ClassifyError(err)
+	pr.ErrorClassCounts[class]++
+	if _, ok := pr.ErrorExamples[class]; !ok && err != nil {
+		pr.ErrorExamples[class] = err.Error()
+	}
+}
+
+// ProfileOptions controls how DoProfile schedules requests against the target
+type ProfileOptions struct {
+	// Repetitions is the total number of requests sent, shared between all workers.
+	// Zero means no limit, in which case Duration must be set.
+	Repetitions int
+	// Duration limits how long the profile runs. Zero means no limit. Whichever of
+	// Repetitions and Duration is reached first ends the profile.
+	Duration time.Duration
+	// Concurrency is the number of workers sending requests in parallel. Values
+	// less than 1 are treated as 1. Concurrency is ignored if Rate is set.
+	Concurrency int
+	// Rate schedules requests at a constant number of requests per second whether
+	// or not earlier requests have completed, and request times are measured from
+	// when each request was due. Zero disables rate scheduling.
+	Rate float64
+	// MaxInFlight caps the number of outstanding requests when Rate is set.
+	// Values less than 1 are treated as defaultMaxInFlight.
+	MaxInFlight int
+	// CompareHandshakes reports the time taken by full and resumed TLS handshakes
+	// separately. It is most useful when the Client shares a ClientSessionCache
+	// between connections.
+	CompareHandshakes bool
+	// Latency controls how request times are recorded; see LatencyOptions
+	Latency LatencyOptions
+	// TraceLog receives a traceRecord encoded as a line of JSON for every request
+	// included in the results. Nil disables the trace log.
+	TraceLog io.Writer
+}
+
+// traceRecord describes a single request in the trace log
+type traceRecord struct {
+	// Start is when the request was sent, or when it was due for rate-scheduled
+	// profiles. Elapsed is measured from Start.
+	Start     time.Time  `json:"start"`
+	Elapsed   float64    `json:"elapsed_ms"`
+	Status    int        `json:"status,omitempty"`
+	BytesRead int        `json:"bytes_read"`
+	Error     ErrorClass `json:"error_class,omitempty"`
+	Message   string     `json:"error,omitempty"`
+	// Worker identifies the worker that sent the request. For rate-scheduled
+	// profiles it identifies one of the MaxInFlight request slots instead.
+	Worker int `json:"worker"`
+}
+
+// profileRun holds the state shared by the Go routines sending requests for a
+// single call to DoProfile
+type profileRun struct {
+	opts   ProfileOptions
+	url    *url.URL
+	client *Client
+	// Closing stopEarly prevents new requests from being sent. Requests that are
+	// already in flight are given a chance to wrap up before abort is closed.
+	stopEarly chan struct{}
+	abort     chan time.Duration
+	stopOnce  sync.Once
+	// remaining is the number of requests left in the repetition budget
+	remaining int64
+	// mu guards results and trace
+	mu      sync.Mutex
+	results *ProfileResults
+	trace   *json.Encoder
+}
+
+// stop ends the profile run. It is safe to call stop more than once.
+func (run *profileRun) stop() {
+	run.stopOnce.Do(func() {
+		close(run.stopEarly)
+		go func() {
+			timeout := time.NewTimer(gracefulCleanupTimeout)
+			<-timeout.C
+			close(run.abort)
+		}()
+	})
+}
+
+// stopped reports whether the profile run has been stopped
+func (run *profileRun) stopped() bool {
+	select {
+	case <-run.stopEarly:
+		return true
+	default:
+		return false
+	}
+}
+
+// claimRequest takes a request from the repetition budget, returning false once
+// the budget is exhausted
+func (run *profileRun) claimRequest() bool {
+	if run.opts.Repetitions <= 0 {
+		return true
+	}
+	return atomic.AddInt64(&run.remaining, -1) >= 0
+}
+
+// doRequest sends a single request on behalf of worker and merges its outcome
+// into the results. The request time is measured from start, which for
+// rate-scheduled requests is the time they were due so that any delay in sending
+// them is included.
+func (run *profileRun) doRequest(worker int, start time.Time) {
+	result, err := run.client.Do(run.url, ioutil.Discard, run.abort)
+	elapsed := time.Since(start)
+	if isAbort(err) {
+		select {
+		case <-run.abort:
+			// The request was cut short by the profile ending
+			return
+		default:
+		}
+	}
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.results.ConnectionsOpened += result.ConnectionsOpened
+	run.results.ConnectionsReused += result.ConnectionsReused
+	if err != nil {
+		run.results.RecordFailedTransaction(err)
+	} else {
+		run.results.UpdateStats(result.Status, elapsed, result.BytesRead)
+		run.results.BytesRead += int64(result.BytesRead)
+		run.results.DecodedBytes += int64(result.BodyBytes)
+		run.results.RecordTimings(result.Timings)
+		run.results.RecordHops(result.Hops)
+	}
+	if run.trace != nil {
+		record := traceRecord{
+			Start:     start,
+			Elapsed:   milliseconds(elapsed),
+			Status:    result.Status,
+			BytesRead: result.BytesRead,
+			Error:     ClassifyError(err),
+			Worker:    worker,
+		}
+		if err != nil {
+			record.Message = err.Error()
+		}
+		// Write errors are sticky in buffered writers so the caller can check for
+		// them once the profile is complete
+		_ = run.trace.Encode(record)
+	}
+}
+
+// runWorkers sends requests from concurrency workers, each of which waits for
+// its current request to complete before sending another
+func (run *profileRun) runWorkers(concurrency int) {
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func(worker int) {
+			defer wg.Done()
+			for run.claimRequest() && !run.stopped() {
+				run.doRequest(worker, time.Now())
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runAtRate sends requests on a fixed timetable of opts.Rate requests per second.
+// Each request is sent from its own Go routine so that slow responses do not
+// delay the schedule. Requests sent more than lateThreshold after their scheduled
+// time are counted as late, and requests that are due while maxInFlight requests
+// are outstanding are dropped.
+func (run *profileRun) runAtRate(maxInFlight int) {
+	interval := time.Duration(float64(time.Second) / run.opts.Rate)
+	// Each request in flight holds one of the slots
+	slots := make(chan int, maxInFlight)
+	for i := 0; i < maxInFlight; i++ {
+		slots <- i
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	begin := time.Now()
+	for i := 0; run.claimRequest(); i++ {
+		scheduled := begin.Add(time.Duration(i) * interval)
+		if wait := time.Until(scheduled); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-run.stopEarly:
+				timer.Stop()
+				return
+			}
+		} else if run.stopped() {
+			return
+		}
+		var slot int
+		select {
+		case slot = <-slots:
+		default:
+			run.mu.Lock()
+			run.results.DroppedRequests++
+			run.mu.Unlock()
+			continue
+		}
+		if time.Since(scheduled) > lateThreshold {
+			run.mu.Lock()
+			run.results.LateRequests++
+			run.mu.Unlock()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.doRequest(slot, scheduled)
+			slots <- slot
+		}()
+	}
 }
 
-// DoProfile sends HTTP GET requests for path to server host on the specified port
-// and records statistics based on the requests. The number of requests sent is
-// specified by the repetitions argument.
+// DoProfile sends HTTP requests for path to server host on the specified port
+// and records statistics based on the requests. Requests are sent until
+// opts.Repetitions requests have been made or opts.Duration has elapsed.
+//
+// By default requests are shared between opts.Concurrency workers, each of which
+// waits for its current request to complete before sending another. If opts.Rate
+// is set requests are instead sent at a constant rate with at most
+// opts.MaxInFlight requests outstanding at any time; requests dropped because
+// the cap was reached still count towards opts.Repetitions.
+//
+// When the profile is stopped early by SIGINT or by reaching opts.Duration,
+// requests that are still in flight are given gracefulCleanupTimeout to complete
+// before they are aborted. Aborted requests are not included in the results.
+// Requests are sent using client, or a zero Client if client is nil.
 // Returns a ProfileResults struct with the results of the profile run.
-func DoProfile(repetitions int, url *url.URL, headers *map[string]string) *ProfileResults {
+func DoProfile(opts ProfileOptions, url *url.URL, client *Client) *ProfileResults {
+	if client == nil {
+		client = &Client{}
+	}
+	run := &profileRun{
+		opts:      opts,
+		url:       url,
+		client:    client,
+		stopEarly: make(chan struct{}),
+		abort:     make(chan time.Duration),
+		remaining: int64(opts.Repetitions),
+		results:   &ProfileResults{},
+	}
+	if opts.TraceLog != nil {
+		run.trace = json.NewEncoder(opts.TraceLog)
+	}
+	run.results.Latency = opts.Latency
+	run.results.Init(opts.Repetitions)
+	run.results.CompareHandshakes = opts.CompareHandshakes
 	// Set up signal handler to terminate early and print stats on sigint
 	sigintChan := make(chan os.Signal, 1)
 	signal.Notify(sigintChan, os.Interrupt)
-	// Defer executes in LIFO order; reset sig handler and then send on chan
-	// and close to unblock Go routine listening on it
+	// Defer executes in LIFO order; reset sig handler and then close the channel
+	// to unblock the Go routine listening on it
 	defer close(sigintChan)
 	defer signal.Reset(os.Interrupt)
-	stopEarly := make(chan time.Duration)
 	go func() {
-		defer func() { recover() }()
-		<-sigintChan
-		// Give the current request a chance to wrap up
-		stopEarly <- gracefulCleanupTimeout
-		close(stopEarly)
+		if _, ok := <-sigintChan; ok {
+			run.stop()
+		}
 	}()
+	if opts.Duration > 0 {
+		deadline := time.AfterFunc(opts.Duration, run.stop)
+		defer deadline.Stop()
+	}
 
-	results := &ProfileResults{}
-	results.Init(repetitions)
-	for i := 0; i < repetitions; i++ {
-		select {
-		// Break out of loop on interrupt
-		case <-stopEarly:
-			return results
-		default:
+	run.results.StartTime = time.Now()
+	defer func() { run.results.EndTime = time.Now() }()
+	if opts.Rate > 0 {
+		maxInFlight := opts.MaxInFlight
+		if maxInFlight < 1 {
+			maxInFlight = defaultMaxInFlight
 		}
-		start := time.Now()
-		status, bytesRead, err := MakeHTTPRequest(url, ioutil.Discard, headers, stopEarly)
-		if err != nil {
-			results.RecordFailedTransaction()
-			continue
+		run.results.TargetRate = opts.Rate
+		run.runAtRate(maxInFlight)
+	} else {
+		concurrency := opts.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
 		}
-		stop := time.Now()
-		elapsed := stop.Sub(start)
-		results.UpdateStats(status, elapsed, bytesRead)
+		run.runWorkers(concurrency)
 	}
-	return results
+	return run.results
 }
@@ -0,0 +1,273 @@
+package quantile
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// DefaultCompression is a compression that suits most uses of TDigest
+const DefaultCompression = 100
+
+// tdigestVersion identifies the layout written by MarshalBinary
+const tdigestVersion = 1
+
+// Centroid summarizes Weight values whose mean is Mean
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigest estimates quantiles of a stream of values in bounded memory using the
+// merging t-digest of Dunning and Ertl. Values are grouped into centroids whose
+// size is limited by the quantile they fall at, so that centroids near the
+// extremes hold few values and the tails are estimated with more accuracy than
+// the middle of the distribution.
+// See https://arxiv.org/abs/1902.04023
+//
+// A TDigest with compression δ keeps at most about δ centroids, plus a buffer of
+// up to 5δ values added since it was last compressed. The error of Quantile(q)
+// is best expressed in terms of rank: the estimate falls between the exact
+// values at quantiles q - ε and q + ε, where ε is at most the width of the
+// centroids near q, 2π·sqrt(q(1-q))/δ, plus one value. For the default
+// compression of 100 that is 3.1% at the median and 0.2% at q = 0.999, although
+// for smooth distributions the error is usually an order of magnitude smaller;
+// it approaches the bound where q falls in a gap between clusters of values. The
+// smallest and largest values are always exact. A digest built by merging others
+// may have up to twice the error. When many values are repeated a centroid may
+// hold two neighboring distinct values, in which case an estimate can also fall
+// between them.
+//
+// TDigest is not safe for concurrent use.
+type TDigest struct {
+	compression float64
+	// centroids are sorted by mean and merged according to the scale function
+	centroids []Centroid
+	// unmerged holds centroids added since the digest was last compressed
+	unmerged []Centroid
+	total    float64
+	min      float64
+	max      float64
+}
+
+// NewTDigest returns an empty TDigest. Larger compressions use more memory and
+// give more accurate quantiles. Compressions less than 20 are treated as 20.
+func NewTDigest(compression float64) *TDigest {
+	if compression < 20 || math.IsNaN(compression) {
+		compression = 20
+	}
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Add records value once. NaN values are ignored.
+func (d *TDigest) Add(value float64) {
+	d.add(Centroid{Mean: value, Weight: 1})
+}
+
+// add records the values summarized by c
+func (d *TDigest) add(c Centroid) {
+	if math.IsNaN(c.Mean) || !(c.Weight > 0) {
+		return
+	}
+	d.unmerged = append(d.unmerged, c)
+	d.total += c.Weight
+	if c.Mean < d.min {
+		d.min = c.Mean
+	}
+	if c.Mean > d.max {
+		d.max = c.Mean
+	}
+	if len(d.unmerged) >= int(5*d.compression) {
+		d.compress()
+	}
+}
+
+// Merge adds the values recorded by other to d. The values recorded by other are
+// not modified.
+func (d *TDigest) Merge(other *TDigest) {
+	// Adding to d changes other if they are the same digest, so its centroids are
+	// copied first
+	other.compress()
+	centroids := append([]Centroid(nil), other.centroids...)
+	for _, c := range centroids {
+		d.add(c)
+	}
+	// Centroids summarize their values by the mean alone, so the extremes of
+	// other must be carried over separately
+	if other.total > 0 {
+		d.min = math.Min(d.min, other.min)
+		d.max = math.Max(d.max, other.max)
+	}
+}
+
+// Count returns the number of values recorded
+func (d *TDigest) Count() int64 {
+	return int64(d.total)
+}
+
+// Centroids returns a copy of the centroids summarizing the recorded values,
+// sorted by mean
+func (d *TDigest) Centroids() []Centroid {
+	d.compress()
+	return append([]Centroid(nil), d.centroids...)
+}
+
+// scale maps quantile q to the k scale of the digest, on which each centroid may
+// span at most one unit. The arcsine shape packs centroids closely near q = 0 and
+// q = 1.
+func (d *TDigest) scale(q float64) float64 {
+	return d.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// compress merges the unmerged centroids into the sorted centroids, combining
+// neighbors as long as the result spans at most one unit of the scale function
+func (d *TDigest) compress() {
+	if len(d.unmerged) == 0 {
+		return
+	}
+	all := append(d.centroids, d.unmerged...)
+	sort.Slice(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+	merged := make([]Centroid, 0, int(d.compression))
+	current := all[0]
+	// Weight of the merged centroids to the left of current
+	var before float64
+	kLeft := d.scale(0)
+	for _, next := range all[1:] {
+		if d.scale((before+current.Weight+next.Weight)/d.total)-kLeft <= 1 {
+			current.Weight += next.Weight
+			current.Mean += (next.Mean - current.Mean) * next.Weight / current.Weight
+			continue
+		}
+		merged = append(merged, current)
+		before += current.Weight
+		kLeft = d.scale(before / d.total)
+		current = next
+	}
+	d.centroids = append(merged, current)
+	d.unmerged = d.unmerged[:0]
+}
+
+// Quantile returns an estimate of the value at quantile q, where 0 <= q <= 1, by
+// interpolating between the centroids on either side of it. Quantile(0) and
+// Quantile(1) return the smallest and largest values recorded. It returns NaN if
+// no values were recorded or q is out of range.
+func (d *TDigest) Quantile(q float64) float64 {
+	if d.total == 0 || !(q >= 0 && q <= 1) {
+		return math.NaN()
+	}
+	d.compress()
+	centroids := d.centroids
+	n := len(centroids)
+	// The rank of q, where the value of rank r is taken to lie between the
+	// values with ranks r - 1/2 and r + 1/2
+	index := q * d.total
+	if index < 1 {
+		return d.min
+	}
+	if index > d.total-1 {
+		return d.max
+	}
+	// Between the smallest value and the center of the first centroid, and the
+	// center of the last centroid and the largest value, values are assumed to be
+	// spread evenly
+	first, last := centroids[0], centroids[n-1]
+	if first.Weight > 2 && index < first.Weight/2 {
+		return d.min + (index-1)/(first.Weight/2-1)*(first.Mean-d.min)
+	}
+	if last.Weight > 2 && d.total-index <= last.Weight/2 {
+		return d.max - (d.total-index-1)/(last.Weight/2-1)*(d.max-last.Mean)
+	}
+	// Otherwise interpolate between the centers of the neighboring centroids. A
+	// centroid holding a single value is treated as exact rather than spread out.
+	center := first.Weight / 2
+	for i := 0; i < n-1; i++ {
+		left, right := centroids[i], centroids[i+1]
+		gap := (left.Weight + right.Weight) / 2
+		if center+gap > index {
+			var leftExact, rightExact float64
+			if left.Weight == 1 {
+				if index-center < 0.5 {
+					return left.Mean
+				}
+				leftExact = 0.5
+			}
+			if right.Weight == 1 {
+				if center+gap-index <= 0.5 {
+					return right.Mean
+				}
+				rightExact = 0.5
+			}
+			toLeft := index - center - leftExact
+			toRight := center + gap - index - rightExact
+			return (left.Mean*toRight + right.Mean*toLeft) / (toLeft + toRight)
+		}
+		center += gap
+	}
+	// Past the center of a last centroid holding a single value
+	return last.Mean
+}
+
+// MarshalBinary encodes the digest so that it can be stored or sent to another
+// process and restored with UnmarshalBinary
+func (d *TDigest) MarshalBinary() ([]byte, error) {
+	d.compress()
+	buf := make([]byte, 0, 1+8*4+16*len(d.centroids))
+	buf = append(buf, tdigestVersion)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(d.compression))
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(d.min))
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(d.max))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(d.centroids)))
+	for _, c := range d.centroids {
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(c.Mean))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(c.Weight))
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary replaces the contents of d with a digest encoded by
+// MarshalBinary
+func (d *TDigest) UnmarshalBinary(data []byte) error {
+	const header = 1 + 8*4
+	if len(data) < header || data[0] != tdigestVersion {
+		return errors.New("quantile: unsupported t-digest encoding")
+	}
+	float := func(offset int) float64 {
+		return math.Float64frombits(binary.BigEndian.Uint64(data[offset:]))
+	}
+	count := binary.BigEndian.Uint64(data[25:])
+	if count > uint64(len(data)-header)/16 || uint64(len(data)-header) != 16*count {
+		return errors.New("quantile: t-digest encoding has the wrong length")
+	}
+	// NewTDigest raises lower compressions to 20, so a digest never has one
+	compression := float(1)
+	if !(compression >= 20) || math.IsInf(compression, 1) {
+		return errors.New("quantile: invalid compression in t-digest encoding")
+	}
+	decoded := NewTDigest(compression)
+	decoded.min, decoded.max = float(9), float(17)
+	if math.IsNaN(decoded.min) || math.IsNaN(decoded.max) {
+		return errors.New("quantile: invalid extremes in t-digest encoding")
+	}
+	decoded.centroids = make([]Centroid, count)
+	for i := range decoded.centroids {
+		c := Centroid{Mean: float(header + 16*i), Weight: float(header + 16*i + 8)}
+		if math.IsNaN(c.Mean) || !(c.Weight > 0) ||
+			(i > 0 && c.Mean < decoded.centroids[i-1].Mean) {
+			return errors.New("quantile: invalid centroid in t-digest encoding")
+		}
+		decoded.centroids[i] = c
+		decoded.total += c.Weight
+	}
+	// The extremes bound the means of the centroids
+	if count > 0 && (decoded.min > decoded.centroids[0].Mean ||
+		decoded.max < decoded.centroids[count-1].Mean) {
+		return errors.New("quantile: invalid extremes in t-digest encoding")
+	}
+	*d = *decoded
+	return nil
+}
@@ -0,0 +1,261 @@
+package quantile
+
+import (
+	"encoding/binary"
+	"jockey/quickselect"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// distributions generate request times with a variety of shapes
+var distributions = map[string]func(r *rand.Rand) time.Duration{
+	"uniform": func(r *rand.Rand) time.Duration {
+		return time.Duration(r.Int63n(int64(time.Second)))
+	},
+	"exponential": func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(10*time.Millisecond))
+	},
+	"lognormal": func(r *rand.Rand) time.Duration {
+		return time.Duration(math.Exp(r.NormFloat64()*1.5) * float64(time.Millisecond))
+	},
+	"bimodal": func(r *rand.Rand) time.Duration {
+		if r.Intn(10) == 0 {
+			return time.Second + time.Duration(r.Int63n(int64(100*time.Millisecond)))
+		}
+		return time.Millisecond + time.Duration(r.Int63n(int64(time.Millisecond)))
+	},
+	"duplicates": func(r *rand.Rand) time.Duration {
+		return time.Duration(r.Intn(5)) * time.Millisecond
+	},
+}
+
+var quantiles = []float64{0, 0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 1}
+
+// exactQuantile returns the exact value at quantile q of times using quick select
+// and the nearest-rank method, clamping q to [0, 1]
+func exactQuantile(t *testing.T, times []time.Duration, q float64) float64 {
+	return exactRank(t, times, int(math.Ceil(q*float64(len(times)))))
+}
+
+// exactRank returns the kth smallest value of times using quick select, clamping
+// k to the number of values
+func exactRank(t *testing.T, times []time.Duration, k int) float64 {
+	if k < 1 {
+		k = 1
+	} else if k > len(times) {
+		k = len(times)
+	}
+	value, err := quickselect.QuickSelect(append([]time.Duration(nil), times...), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return float64(value)
+}
+
+// checkQuantiles reports whether every estimated quantile of digest lies between
+// the exact values of times at quantiles q - ε and q + ε, where ε is the bound
+// documented for TDigest scaled by factor, allowing for repeated values
+func checkQuantiles(t *testing.T, digest *TDigest, times []time.Duration, factor float64) bool {
+	ok := true
+	for _, q := range quantiles {
+		epsilon := factor*2*math.Pi*math.Sqrt(q*(1-q))/DefaultCompression + 1/float64(len(times))
+		estimate := digest.Quantile(q)
+		low := exactQuantile(t, times, q-epsilon)
+		high := exactQuantile(t, times, q+epsilon)
+		// The estimate may lie between low or high and the neighboring distinct
+		// value if a centroid holds both
+		var below, atMost int
+		for _, value := range times {
+			if float64(value) < low {
+				below++
+			}
+			if float64(value) <= high {
+				atMost++
+			}
+		}
+		if below > 0 {
+			low = exactRank(t, times, below)
+		}
+		if atMost < len(times) {
+			high = exactRank(t, times, atMost+1)
+		}
+		if estimate < low || estimate > high {
+			t.Errorf("q%v of %d values: estimate %v outside exact range %v to %v\n", q, len(times),
+				time.Duration(estimate), time.Duration(low), time.Duration(high))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// generate returns n request times drawn from distribution, sorted if requested
+// since sorted input is the hardest case for a t-digest
+func generate(seed int64, n int, distribution func(r *rand.Rand) time.Duration,
+	sorted bool) []time.Duration {
+
+	r := rand.New(rand.NewSource(seed))
+	times := make([]time.Duration, n)
+	for i := range times {
+		times[i] = distribution(r)
+	}
+	if sorted {
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	}
+	return times
+}
+
+// Quantiles should be within the documented rank error of the exact answers
+// given by quick select
+func TestQuantile(t *testing.T) {
+	for name, distribution := range distributions {
+		property := func(seed int64, size uint16, sorted bool) bool {
+			times := generate(seed, int(size)%20_000+1, distribution, sorted)
+			digest := NewTDigest(DefaultCompression)
+			for _, value := range times {
+				digest.Add(float64(value))
+			}
+			if digest.Count() != int64(len(times)) {
+				t.Errorf("%s: expected count %d got %d\n", name, len(times), digest.Count())
+				return false
+			}
+			return checkQuantiles(t, digest, times, 1)
+		}
+		if err := quick.Check(property, &quick.Config{MaxCount: 20}); err != nil {
+			t.Errorf("%s: %v\n", name, err)
+		}
+	}
+}
+
+// The tails of smooth distributions should be estimated well within the bound
+func TestQuantileTails(t *testing.T) {
+	times := generate(1, 100_000, distributions["lognormal"], false)
+	digest := NewTDigest(DefaultCompression)
+	for _, value := range times {
+		digest.Add(float64(value))
+	}
+	for _, q := range []float64{0.0001, 0.001, 0.999, 0.9999} {
+		estimate := digest.Quantile(q)
+		low, high := exactQuantile(t, times, q-0.0005), exactQuantile(t, times, q+0.0005)
+		if estimate < low || estimate > high {
+			t.Errorf("q%v: estimate %v outside exact range %v to %v\n", q, time.Duration(estimate),
+				time.Duration(low), time.Duration(high))
+		}
+	}
+	if len(digest.Centroids()) > 2*DefaultCompression {
+		t.Errorf("expected at most %d centroids got %d\n", 2*DefaultCompression,
+			len(digest.Centroids()))
+	}
+}
+
+// Merging digests of parts of a stream should give at most twice the error of a
+// digest of the whole stream
+func TestMerge(t *testing.T) {
+	for name, distribution := range distributions {
+		property := func(seed int64, size uint16, parts uint8) bool {
+			times := generate(seed, int(size)%20_000+1, distribution, false)
+			digests := make([]*TDigest, int(parts)%16+1)
+			for i := range digests {
+				digests[i] = NewTDigest(DefaultCompression)
+			}
+			for i, value := range times {
+				digests[i%len(digests)].Add(float64(value))
+			}
+			merged := NewTDigest(DefaultCompression)
+			for _, digest := range digests {
+				merged.Merge(digest)
+			}
+			if merged.Count() != int64(len(times)) {
+				t.Errorf("%s: expected count %d got %d\n", name, len(times), merged.Count())
+				return false
+			}
+			if !checkQuantiles(t, merged, times, 2) {
+				return false
+			}
+			// Merging a digest into itself records each of its values twice
+			merged.Merge(merged)
+			if merged.Count() != 2*int64(len(times)) {
+				t.Errorf("%s: expected count %d after merging with itself got %d\n", name,
+					2*len(times), merged.Count())
+				return false
+			}
+			return checkQuantiles(t, merged, append(times, times...), 2)
+		}
+		if err := quick.Check(property, &quick.Config{MaxCount: 20}); err != nil {
+			t.Errorf("%s: %v\n", name, err)
+		}
+	}
+}
+
+// A digest restored from its encoding should give the same quantiles
+func TestMarshalBinary(t *testing.T) {
+	property := func(seed int64, size uint16) bool {
+		times := generate(seed, int(size)%5_000+1, distributions["exponential"], false)
+		digest := NewTDigest(DefaultCompression)
+		for _, value := range times {
+			digest.Add(float64(value))
+		}
+		encoded, err := digest.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded TDigest
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range quantiles {
+			if decoded.Quantile(q) != digest.Quantile(q) {
+				t.Errorf("q%v: expected %v after decoding got %v\n", q, digest.Quantile(q),
+					decoded.Quantile(q))
+				return false
+			}
+		}
+		return decoded.Count() == digest.Count()
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 20}); err != nil {
+		t.Error(err)
+	}
+
+	encoded, _ := NewTDigest(DefaultCompression).MarshalBinary()
+	invalid := [][]byte{nil, {2}, encoded[:len(encoded)-1], append(encoded, 0)}
+	// Replace the float at offset in the encoding of a digest holding 1 and 2
+	digest := NewTDigest(DefaultCompression)
+	digest.Add(1)
+	digest.Add(2)
+	withFloat := func(offset int, value float64) []byte {
+		encoded, _ := digest.MarshalBinary()
+		binary.BigEndian.PutUint64(encoded[offset:], math.Float64bits(value))
+		return encoded
+	}
+	var decoded TDigest
+	if err := decoded.UnmarshalBinary(withFloat(9, 0.5)); err != nil {
+		t.Errorf("expected a minimum below the centroids to decode, got %v\n", err)
+	}
+	invalid = append(invalid,
+		withFloat(1, 19), withFloat(1, math.NaN()), withFloat(1, math.Inf(1)),
+		withFloat(9, math.NaN()), withFloat(9, 1.5),
+		withFloat(17, math.NaN()), withFloat(17, 1.5))
+	for _, invalid := range invalid {
+		var decoded TDigest
+		if err := decoded.UnmarshalBinary(invalid); err == nil {
+			t.Errorf("expected error decoding %v\n", invalid)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	digest := NewTDigest(DefaultCompression)
+	if !math.IsNaN(digest.Quantile(0.5)) || digest.Count() != 0 {
+		t.Errorf("expected NaN quantile and zero count from empty digest\n")
+	}
+	digest.Add(42)
+	if digest.Quantile(0) != 42 || digest.Quantile(0.5) != 42 || digest.Quantile(1) != 42 {
+		t.Errorf("expected every quantile of a single value to be that value\n")
+	}
+	if !math.IsNaN(digest.Quantile(-0.1)) || !math.IsNaN(digest.Quantile(1.1)) {
+		t.Errorf("expected NaN for quantiles out of range\n")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RedirectError is returned when a Client following redirects stops because of
+// the redirect limit, a redirect loop or a Location it cannot follow
+type RedirectError struct {
+	Reason string
+}
+
+func (e *RedirectError) Error() string {
+	return "redirect: " + e.Reason
+}
+
+// request holds the parts of a request that can change while following redirects
+type request struct {
+	url    *url.URL
+	method string
+	body   RequestBody
+	// deadline by which the request and any redirects must complete, if not zero
+	deadline time.Time
+	// crossOrigin is set once a redirect has changed the host or scheme of the
+	// original request, after which headers that carry credentials or name the
+	// original host are no longer sent
+	crossOrigin bool
+}
+
+// crossOriginHeaders are the caller's header fields that are dropped when a
+// redirect leads to another host or scheme, as net/http does
+var crossOriginHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Host":          true,
+}
+
+// sameOrigin reports whether a and b have the same scheme, host and port, where a
+// URL without a port uses the default port for its scheme
+func sameOrigin(a, b *url.URL) bool {
+	port := func(u *url.URL) string {
+		if u.Port() != "" {
+			return u.Port()
+		}
+		if strings.EqualFold(u.Scheme, "https") {
+			return "443"
+		}
+		return "80"
+	}
+	return strings.EqualFold(a.Scheme, b.Scheme) &&
+		strings.EqualFold(a.Hostname(), b.Hostname()) && port(a) == port(b)
+}
+
+// key identifies requests that are expected to receive the same response
+func (r request) key() string {
+	return r.method + " " + r.url.String()
+}
+
+// isRedirect reports whether status asks the client to repeat the request at the
+// URL given by the Location header
+func isRedirect(status int) bool {
+	switch status {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+// redirect returns the request that follows a response to r with a redirect
+// status and location.
+//
+// Once a redirect changes the host or scheme, the caller's Authorization, Cookie
+// and Host header fields are no longer sent, even if a later redirect returns to
+// the original host.
+//
+// 303 responses are followed with a GET request without a body unless r used the
+// HEAD method. For historical reasons clients change POST requests to GET when
+// following 301 and 302 responses, which Jockey does as well. 307 and 308
+// responses are followed using the original method and body.
+// See https://tools.ietf.org/html/rfc7231#section-6.4
+func (r request) redirect(status int, location string) (request, error) {
+	next, err := r.url.Parse(location)
+	if err != nil {
+		return request{}, &RedirectError{
+			Reason: fmt.Sprintf("bad Location %q: %v", location, err)}
+	}
+	next.Scheme = strings.ToLower(next.Scheme)
+	switch next.Scheme {
+	case "http":
+		if next.Port() == "" {
+			next.Host += ":80"
+		}
+	case "https":
+		if next.Port() == "" {
+			next.Host += ":443"
+		}
+	default:
+		return request{}, &RedirectError{
+			Reason: fmt.Sprintf("unsupported Location %q", location)}
+	}
+	redirected := request{url: next, method: r.method, body: r.body, deadline: r.deadline,
+		crossOrigin: r.crossOrigin || !sameOrigin(r.url, next)}
+	switch {
+	case status == 303 && r.method != "HEAD",
+		(status == 301 || status == 302) && r.method == "POST":
+		redirected.method = "GET"
+		redirected.body = nil
+	}
+	return redirected, nil
+}
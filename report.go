@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProfileReportVersion identifies the layout of ProfileReport. It is incremented
+// whenever a field is removed or changes meaning so that consumers can detect
+// incompatible reports. Fields may be added without changing the version.
+const ProfileReportVersion = 1
+
+// ProfileReport is the machine-readable form of ProfileResults. All times are in
+// fractional milliseconds unless the field name says otherwise.
+type ProfileReport struct {
+	Version        int              `json:"version"`
+	URL            string           `json:"url"`
+	StartTime      time.Time        `json:"start_time"`
+	EndTime        time.Time        `json:"end_time"`
+	Requests       int              `json:"requests"`
+	FailedRequests int              `json:"failed_requests"`
+	Latency        LatencyReport    `json:"latency"`
+	Phases         []PhaseReport    `json:"phases"`
+	ResponseBytes  ByteSizeReport   `json:"response_bytes"`
+	Connections    ConnectionReport `json:"connections"`
+	StatusCodes    map[string]int   `json:"status_codes"`
+	// ErrorClasses counts requests that failed without a valid response by cause,
+	// and ErrorExamples holds the message of the first error seen in each class
+	ErrorClasses  map[ErrorClass]int    `json:"error_classes"`
+	ErrorExamples map[ErrorClass]string `json:"error_examples"`
+	Rate          *RateReport           `json:"rate,omitempty"`
+}
+
+// LatencyReport summarizes the total time taken by successful requests
+type LatencyReport struct {
+	Min    float64 `json:"min_ms"`
+	Max    float64 `json:"max_ms"`
+	Mean   float64 `json:"mean_ms"`
+	Median float64 `json:"median_ms"`
+	// Percentiles maps labels such as p99.9 to the request time at that percentile
+	Percentiles map[string]float64 `json:"percentiles_ms"`
+}
+
+// PhaseReport summarizes the time taken by a single phase of successful requests
+type PhaseReport struct {
+	Name   string  `json:"name"`
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean_ms"`
+	Median float64 `json:"median_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+// ByteSizeReport summarizes the size of responses including headers. DecodedBody
+// is the total size of response bodies after removing any content coding.
+type ByteSizeReport struct {
+	Smallest    int   `json:"smallest"`
+	Largest     int   `json:"largest"`
+	Total       int64 `json:"total"`
+	DecodedBody int64 `json:"decoded_body_total"`
+}
+
+// ConnectionReport counts the connections used over the course of the profile
+type ConnectionReport struct {
+	Opened int `json:"opened"`
+	Reused int `json:"reused"`
+}
+
+// RateReport summarizes the schedule of rate-scheduled profiles
+type RateReport struct {
+	Target  float64 `json:"target_per_second"`
+	Late    int     `json:"late_requests"`
+	Dropped int     `json:"dropped_requests"`
+}
+
+// Report builds a ProfileReport from the results of a profile run against target
+func (pr *ProfileResults) Report(target *url.URL) *ProfileReport {
+	report := &ProfileReport{
+		Version:        ProfileReportVersion,
+		URL:            target.String(),
+		StartTime:      pr.StartTime,
+		EndTime:        pr.EndTime,
+		Requests:       pr.Requests,
+		FailedRequests: pr.FailedRequests,
+		Connections: ConnectionReport{
+			Opened: pr.ConnectionsOpened,
+			Reused: pr.ConnectionsReused,
+		},
+		Phases:        []PhaseReport{},
+		StatusCodes:   make(map[string]int, len(pr.StatusCodeCounts)),
+		ErrorClasses:  make(map[ErrorClass]int, len(pr.ErrorClassCounts)),
+		ErrorExamples: make(map[ErrorClass]string, len(pr.ErrorExamples)),
+	}
+	report.Latency.Percentiles = make(map[string]float64, len(pr.Percentiles))
+	// Fastest and SmallestResponseBytes hold sentinel values until a request succeeds
+	if pr.latencies.Count() > 0 {
+		report.Latency.Min = milliseconds(pr.Fastest)
+		report.Latency.Max = milliseconds(pr.Slowest)
+		report.Latency.Mean = milliseconds(time.Duration(pr.MeanTime))
+		report.Latency.Median = milliseconds(pr.GetMedian())
+		for _, p := range pr.Percentiles {
+			label := "p" + strconv.FormatFloat(p, 'f', -1, 64)
+			report.Latency.Percentiles[label] = milliseconds(pr.GetPercentile(p))
+		}
+		report.ResponseBytes.Smallest = pr.SmallestResponseBytes
+		report.ResponseBytes.Largest = pr.LargestResponseBytes
+		report.ResponseBytes.Total = pr.BytesRead
+		report.ResponseBytes.DecodedBody = pr.DecodedBytes
+	}
+	for _, phase := range pr.phases() {
+		if phase.stats.Count == 0 {
+			continue
+		}
+		report.Phases = append(report.Phases, PhaseReport{
+			Name:   phase.key,
+			Count:  phase.stats.Count,
+			Mean:   milliseconds(time.Duration(phase.stats.Mean)),
+			Median: milliseconds(phase.stats.Median()),
+			Max:    milliseconds(phase.stats.Max),
+		})
+	}
+	for code, count := range pr.StatusCodeCounts {
+		report.StatusCodes[strconv.Itoa(code)] = count
+	}
+	for class, count := range pr.ErrorClassCounts {
+		report.ErrorClasses[class] = count
+	}
+	for class, example := range pr.ErrorExamples {
+		report.ErrorExamples[class] = example
+	}
+	if pr.TargetRate > 0 {
+		report.Rate = &RateReport{
+			Target:  pr.TargetRate,
+			Late:    pr.LateRequests,
+			Dropped: pr.DroppedRequests,
+		}
+	}
+	return report
+}
+
+// JSON returns the results of a profile run against target as an indented
+// ProfileReport JSON document
+func (pr *ProfileResults) JSON(target *url.URL) ([]byte, error) {
+	return json.MarshalIndent(pr.Report(target), "", "  ")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ConnectTo replaces the host and port connected to for requests to Host and Port
+// with ToHost and ToPort. Empty fields match any host or port, or leave the host or
+// port connected to unchanged.
+type ConnectTo struct {
+	Host   string
+	Port   string
+	ToHost string
+	ToPort string
+}
+
+// ParseResolve parses an address override in the form host:port:addr[,addr...]
+// such as example.com:443:10.0.0.1,10.0.0.2 and returns the host:port pair that is
+// overridden along with the addresses to connect to instead. IPv6 addresses may be
+// enclosed in brackets.
+func ParseResolve(value string) (string, []string, error) {
+	host, port, rest, err := splitHostPortPrefix(value)
+	if err != nil || host == "" || port == "" || rest == "" {
+		return "", nil, fmt.Errorf("invalid resolve %q: expected host:port:addr", value)
+	}
+	var addresses []string
+	for _, addr := range strings.Split(rest, ",") {
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+		if ip == nil {
+			return "", nil, fmt.Errorf("invalid resolve %q: %q is not an IP address", value, addr)
+		}
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), addresses, nil
+}
+
+// ParseConnectTo parses a connection override in the form host:port:tohost:toport
+// such as example.com:443:backend.internal:8443. Any of the fields may be empty.
+func ParseConnectTo(value string) (ConnectTo, error) {
+	host, port, rest, err := splitHostPortPrefix(value)
+	if err != nil {
+		return ConnectTo{}, fmt.Errorf("invalid connect-to %q: expected host:port:tohost:toport",
+			value)
+	}
+	toHost, toPort, extra, err := splitHostPortPrefix(rest + ":")
+	if err != nil || extra != "" {
+		return ConnectTo{}, fmt.Errorf("invalid connect-to %q: expected host:port:tohost:toport",
+			value)
+	}
+	return ConnectTo{Host: strings.ToLower(host), Port: port, ToHost: toHost, ToPort: toPort}, nil
+}
+
+// splitHostPortPrefix splits value in the form host:port:rest, where host may be
+// an IPv6 address enclosed in brackets and port may be empty
+func splitHostPortPrefix(value string) (host, port, rest string, err error) {
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]:")
+		if end < 0 {
+			return "", "", "", fmt.Errorf("missing ] in %q", value)
+		}
+		host, value = value[1:end], value[end+2:]
+	} else {
+		colon := strings.IndexByte(value, ':')
+		if colon < 0 {
+			return "", "", "", fmt.Errorf("missing port in %q", value)
+		}
+		host, value = value[:colon], value[colon+1:]
+	}
+	colon := strings.IndexByte(value, ':')
+	if colon < 0 {
+		return "", "", "", fmt.Errorf("missing port in %q", value)
+	}
+	port, rest = value[:colon], value[colon+1:]
+	if port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return host, port, rest, nil
+}
+
+// overrideAddress returns the addresses to try in order when connecting to address,
+// after applying ConnectTo and Resolve. The host in the returned addresses is
+// only resolved by DNS if Resolve has no entry for it.
+func (c *Client) overrideAddress(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	host = strings.ToLower(host)
+	for _, override := range c.ConnectTo {
+		if (override.Host == "" || override.Host == host) &&
+			(override.Port == "" || override.Port == port) {
+			if override.ToHost != "" {
+				host = strings.ToLower(override.ToHost)
+			}
+			if override.ToPort != "" {
+				port = override.ToPort
+			}
+			break
+		}
+	}
+	address = net.JoinHostPort(host, port)
+	addresses := c.Resolve[address]
+	if len(addresses) == 0 {
+		return []string{address}, nil
+	}
+	// Start from the next address in turn, falling back to the others in order
+	c.resolveMu.Lock()
+	if c.resolveNext == nil {
+		c.resolveNext = make(map[string]int)
+	}
+	next := c.resolveNext[address]
+	c.resolveNext[address] = (next + 1) % len(addresses)
+	c.resolveMu.Unlock()
+	rotated := make([]string, 0, len(addresses))
+	rotated = append(rotated, addresses[next:]...)
+	return append(rotated, addresses[:next]...), nil
+}
+
+// dial opens a connection to address using the Client's Dialer, or over TCP after
+// applying the Client's address overrides if it has none, and records the time
+// taken in timings
+func (c *Client) dial(ctx context.Context, address string, timings *PhaseTimings) (
+	net.Conn, error) {
+
+	if c.Dialer != nil {
+		return c.Dialer.Dial(ctx, address, timings)
+	}
+	addresses, err := c.overrideAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 1 {
+		return dialTimed(ctx, addresses[0], timings)
+	}
+	return dialAddresses(ctx, addresses, timings)
+}
+
+// dialContext is used by the HTTP/2 transport to apply the Client's Dialer, proxy
+// and address overrides within ConnectTimeout. Dialing through net.Dialer reports
+// DNS lookups and connections to any trace in ctx, while the times measured by a
+// Dialer are not reported.
+func (c *Client) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	deadline, _ := ctx.Deadline()
+	connect := c.limit("connect", c.ConnectTimeout, deadline)
+	ctx, cancel := connect.context(ctx)
+	defer cancel()
+	conn, err := c.dialHTTP2(ctx, network, address)
+	// The transport cannot tell a tunnel that timed out from a stalled TLS
+	// handshake, so timeouts are reported here
+	return conn, connect.wrap(err)
+}
+
+// dialHTTP2 opens a connection for the HTTP/2 transport to address. Tunnels
+// through a proxy are opened here rather than by the transport, which then treats
+// them as direct connections to address.
+func (c *Client) dialHTTP2(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.Proxy != nil {
+		var timings PhaseTimings
+		return c.dialTunnel(ctx, address, &timings)
+	}
+	if c.Dialer != nil {
+		var timings PhaseTimings
+		return c.Dialer.Dial(ctx, address, &timings)
+	}
+	addresses, err := c.overrideAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	var conn net.Conn
+	for _, addr := range addresses {
+		conn, err = dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			break
+		}
+	}
+	return conn, err
+}
@@ -2,13 +2,32 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -41,7 +60,8 @@ func (ms *mockServer) responseLengths() []int {
 // done with the mockServer to avoid leaking its Go routine.
 func (ms *mockServer) start(t *testing.T) {
 	if ms.listener == nil || ms.responses == nil {
-		t.Fatal("uninitialized mock server")
+		t.Error("uninitialized mock server")
+		return
 	}
 	for i := 0; ; i = (i + 1) % len(ms.responses) {
 		clientSock, err := ms.listener.Accept()
@@ -174,7 +194,7 @@ func TestResponseCodes(t *testing.T) {
 	if err != nil {
 		t.Fatal("error parsing mock server url")
 	}
-	responses := DoProfile(numberOfResponses, parsedURL, nil)
+	responses := DoProfile(ProfileOptions{Repetitions: numberOfResponses}, parsedURL, nil)
 	if !reflect.DeepEqual(responses.StatusCodeCounts, statusCodeCounts) {
 		t.Errorf("mismatch in expected status codes:\ngot:      %v\nexpected: %v\n",
 			responses.StatusCodeCounts, statusCodeCounts)
@@ -210,6 +230,59 @@ func TestAbortHTTPRequest(t *testing.T) {
 	}
 }
 
+// Aborting a request should also unblock it before the response, while the TLS
+// handshake, a proxy tunnel or sending the body is stalled
+func TestAbortBeforeResponse(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	// Accept connections but never answer them
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	address := listener.Addr().String()
+	silentProxy, _ := ParseProxyURL("http://" + address)
+	silentSOCKS, _ := ParseProxyURL("socks5://" + address)
+	for _, test := range []struct {
+		name   string
+		url    string
+		client *Client
+	}{
+		{"TLS", "https://" + address, &Client{}},
+		{"CONNECT", "https://example.com:443", &Client{Proxy: silentProxy}},
+		{"SOCKS5", "http://example.com:80", &Client{Proxy: silentSOCKS}},
+		{"HTTP/2 CONNECT", "https://example.com:443", &Client{Proxy: silentProxy, HTTP2: true}},
+		// The body is too large to fit in the socket buffers
+		{"body", "http://" + address, &Client{Method: "POST",
+			Body: BytesBody(strings.Repeat("Jockey go fast. ", 1<<20))}},
+	} {
+		requestURL, _ := url.Parse(test.url)
+		abort := make(chan time.Duration)
+		time.AfterFunc(50*time.Millisecond, func() { close(abort) })
+		done := make(chan error, 1)
+		go func() {
+			_, err := test.client.Do(requestURL, ioutil.Discard, abort)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: expected aborted request to fail\n", test.name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: request was not aborted\n", test.name)
+		}
+	}
+}
+
 func TestBadResponseLines(t *testing.T) {
 	listener, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
@@ -230,18 +303,23 @@ func TestBadResponseLines(t *testing.T) {
 		t.Fatal("error parsing mock server url")
 	}
 	reps := len(serverResponse)
-	results := DoProfile(reps, parsedURL, nil)
+	results := DoProfile(ProfileOptions{Repetitions: reps}, parsedURL, nil)
 	if results.Requests != reps {
 		t.Errorf("expected %d requests from profile got %d\n", reps, results.Requests)
 	}
 	if results.FailedRequests != reps {
 		t.Errorf("expected %d failed requests from profile got %d\n", reps, results.FailedRequests)
 	}
-
+	if results.ErrorClassCounts[ErrorProtocol] != reps {
+		t.Errorf("expected %d protocol errors got %v\n", reps, results.ErrorClassCounts)
+	}
+	if !strings.Contains(results.ErrorExamples[ErrorProtocol], "bad status line") {
+		t.Errorf("unexpected example protocol error %q\n", results.ErrorExamples[ErrorProtocol])
+	}
 }
 
-// Jockey should discard interim 100 Continue status codes and continue
-// with its request
+// Jockey should discard interim 1xx status codes such as 100 Continue and
+// continue with its request
 func Test100Continue(t *testing.T) {
 	listener, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
@@ -251,6 +329,8 @@ func Test100Continue(t *testing.T) {
 	serverResponse := [][]string{
 		{"HTTP/1.1 100 Continue\r\n", "HTTP/1.1 200 OK\r\n", "\r\n"},
 		{"HTTP/1.1 100 Continue\r\n", "HTTP/1.1 100 Continue\r\n", "HTTP/1.1 200 OK\r\n", "\r\n"},
+		{"HTTP/1.1 102 Processing\r\n\r\n", "HTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\n",
+			"HTTP/1.1 200 OK\r\n", "\r\n"},
 	}
 	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse}
 	go ms.start(t)
@@ -274,6 +354,54 @@ func Test100Continue(t *testing.T) {
 	}
 }
 
+// 101 Switching Protocols is only valid in answer to an Upgrade request, which
+// Jockey never sends
+func TestSwitchingProtocols(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		fmt.Fprint(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n")
+	}()
+	_, _, _, err := ReadResponse(client, ioutil.Discard, nil)
+	if ClassifyError(err) != ErrorProtocol {
+		t.Errorf("expected protocol error for 101 response, got %v\n", err)
+	}
+}
+
+// The Connection header holds a comma-separated list of options, any of which may
+// decide whether the connection can be reused
+func TestConnectionHeader(t *testing.T) {
+	cases := []struct {
+		response string
+		reusable bool
+	}{
+		{"HTTP/1.1 200 OK\r\n", true},
+		{"HTTP/1.1 200 OK\r\nConnection: close\r\n", false},
+		{"HTTP/1.1 200 OK\r\nConnection: TE, Close\r\n", false},
+		{"HTTP/1.1 200 OK\r\nConnection: TE\r\nConnection: close\r\n", false},
+		{"HTTP/1.0 200 OK\r\n", false},
+		{"HTTP/1.0 200 OK\r\nConnection: keep-alive\r\n", true},
+		{"HTTP/1.0 200 OK\r\nConnection: Keep-Alive, TE\r\n", true},
+	}
+	for _, testCase := range cases {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			fmt.Fprint(server, testCase.response+"Content-Length: 2\r\n\r\nhi")
+		}()
+		resp, err := readResponse(client, bufio.NewReader(client),
+			func(*response) io.Writer { return ioutil.Discard }, nil, false, false)
+		client.Close()
+		if err != nil {
+			t.Fatalf("%q: %s\n", testCase.response, err)
+		}
+		if resp.reusable != testCase.reusable {
+			t.Errorf("%q: expected reusable %v got %v\n", testCase.response, testCase.reusable,
+				resp.reusable)
+		}
+	}
+}
+
 func TestParseFuzzyHttpUrl(t *testing.T) {
 	// URL test case for ParseFuzzyHTTPUrl
 	type urlCase struct {
@@ -326,3 +454,1651 @@ func TestParseFuzzyHttpUrl(t *testing.T) {
 		}
 	}
 }
+
+// Requests should be shared between workers without losing any results
+func TestProfileConcurrency(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	serverResponse := [][]string{{"HTTP/1.1 200 OK\r\n", "\r\n"}}
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	reps := 50
+	results := DoProfile(ProfileOptions{Repetitions: reps, Concurrency: 8}, parsedURL, nil)
+	if results.Requests != reps {
+		t.Errorf("expected %d requests from profile got %d\n", reps, results.Requests)
+	}
+	if results.StatusCodeCounts[200] != reps {
+		t.Errorf("expected %d successful requests got %d\n", reps, results.StatusCodeCounts[200])
+	}
+}
+
+// A profile with a duration and no repetition limit should stop shortly after
+// the deadline, aborting requests that are still in flight
+func TestProfileDuration(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	serverResponse := [][]string{{"HTTP/1.1 200 OK\r\n", "\r\n"}}
+	serverDelay := time.Millisecond * 20
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse, delay: serverDelay}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	duration := time.Millisecond * 200
+	start := time.Now()
+	results := DoProfile(ProfileOptions{Duration: duration, Concurrency: 2}, parsedURL, nil)
+	elapsed := time.Since(start)
+	if elapsed > duration+gracefulCleanupTimeout+serverDelay*5 {
+		t.Errorf("profile ran for %v, expected about %v\n", elapsed, duration)
+	}
+	if results.Requests == 0 {
+		t.Errorf("expected requests to be sent before the deadline")
+	}
+	if results.FailedRequests != 0 {
+		t.Errorf("expected no failed requests got %d\n", results.FailedRequests)
+	}
+}
+
+// Requests that fail for reasons of their own are counted even if they complete
+// after in-flight requests have been aborted
+func TestProfileFailureAfterAbort(t *testing.T) {
+	dialer := DialerFunc(func(ctx context.Context, address string, timings *PhaseTimings) (
+		net.Conn, error) {
+		time.Sleep(gracefulCleanupTimeout + 100*time.Millisecond)
+		return nil, errors.New("unreachable")
+	})
+	requestURL, _ := url.Parse("http://localhost:80")
+	results := DoProfile(ProfileOptions{Duration: 50 * time.Millisecond}, requestURL,
+		&Client{Dialer: dialer})
+	if results.FailedRequests != 1 {
+		t.Errorf("expected 1 failed request, got %d\n", results.FailedRequests)
+	}
+}
+
+// Rate-scheduled profiles should send every request when the server keeps up
+// and drop requests once the in-flight cap is reached
+func TestProfileRate(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	serverResponse := [][]string{{"HTTP/1.1 200 OK\r\n", "\r\n"}}
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	reps := 20
+	var traceLog bytes.Buffer
+	results := DoProfile(ProfileOptions{Repetitions: reps, Rate: 200, TraceLog: &traceLog},
+		parsedURL, nil)
+	if results.Requests+results.DroppedRequests != reps {
+		t.Errorf("expected %d scheduled requests got %d sent and %d dropped\n",
+			reps, results.Requests, results.DroppedRequests)
+	}
+	// Request times are measured from the schedule rather than when each request
+	// happened to be sent
+	decoder := json.NewDecoder(&traceLog)
+	var first time.Time
+	for decoder.More() {
+		var record traceRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if first.IsZero() {
+			first = record.Start
+		}
+		if offset := record.Start.Sub(first); offset%(5*time.Millisecond) != 0 {
+			t.Errorf("expected requests to start on the 5ms schedule, got offset %v\n", offset)
+		}
+	}
+
+	// A single slow request in flight blocks every request scheduled while the
+	// server is delaying its response
+	slowListener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer slowListener.Close()
+	slow := &mockServer{listener: slowListener.(*net.TCPListener), responses: serverResponse,
+		delay: time.Millisecond * 100}
+	go slow.start(t)
+	slowURL, err := url.Parse("http://" + slowListener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	results = DoProfile(ProfileOptions{Repetitions: reps, Rate: 200, MaxInFlight: 1}, slowURL, nil)
+	if results.DroppedRequests == 0 {
+		t.Errorf("expected requests to be dropped at the in-flight cap")
+	}
+	if results.Requests+results.DroppedRequests != reps {
+		t.Errorf("expected %d scheduled requests got %d sent and %d dropped\n",
+			reps, results.Requests, results.DroppedRequests)
+	}
+}
+
+func TestRateFlag(t *testing.T) {
+	cases := []struct {
+		raw         string
+		expected    float64
+		expectError bool
+	}{
+		{"500/s", 500, false},
+		{"500", 500, false},
+		{"30/m", 0.5, false},
+		{"5/100ms", 50, false},
+		{"1.5/1s", 1.5, false},
+		{"0/s", 0, true},
+		{"fast", 0, true},
+		{"10/lightyear", 0, true},
+	}
+	for _, testCase := range cases {
+		var rf rateFlag
+		err := rf.Set(testCase.raw)
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("expected error parsing rate %s\n", testCase.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsing rate %s returned error %s\n", testCase.raw, err)
+		} else if rf.value != testCase.expected {
+			t.Errorf("parsing rate %s: got %v expected %v\n", testCase.raw, rf.value, testCase.expected)
+		}
+	}
+}
+
+func TestGetPercentile(t *testing.T) {
+	exact := &ProfileResults{Latency: LatencyOptions{Exact: true}}
+	exact.Init(100)
+	// The default histogram keeps three significant digits
+	histogram := &ProfileResults{}
+	histogram.Init(100)
+	// Record the times out of order so that the percentiles must be selected
+	for _, i := range rand.Perm(100) {
+		exact.UpdateStats(200, time.Duration(i+1)*time.Millisecond, 0)
+		histogram.UpdateStats(200, time.Duration(i+1)*time.Millisecond, 0)
+	}
+	cases := map[float64]time.Duration{
+		0.5:  time.Millisecond,
+		50:   50 * time.Millisecond,
+		90:   90 * time.Millisecond,
+		99:   99 * time.Millisecond,
+		99.9: 100 * time.Millisecond,
+		100:  100 * time.Millisecond,
+	}
+	for p, expected := range cases {
+		if got := exact.GetPercentile(p); got != expected {
+			t.Errorf("p%v: expected %v got %v\n", p, expected, got)
+		}
+		if got := histogram.GetPercentile(p); got < expected || got > expected+expected/1000 {
+			t.Errorf("p%v: expected %v to three significant digits got %v\n", p, expected, got)
+		}
+	}
+	// The median should be cached between calls
+	if exact.GetMedian() != exact.GetMedian() {
+		t.Errorf("median changed between calls")
+	}
+	if exact.MeanTime != histogram.MeanTime || histogram.Slowest != 100*time.Millisecond {
+		t.Errorf("expected exact mean and slowest times from histogram, got %v and %v\n",
+			time.Duration(histogram.MeanTime), histogram.Slowest)
+	}
+	if histogram.requestTimes != nil {
+		t.Errorf("expected request times to be kept only when exact\n")
+	}
+}
+
+func TestClientPhaseTimings(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	serverResponse := [][]string{{"HTTP/1.1 200 OK\r\n", "\r\n", "Jockey go fast"}}
+	serverDelay := time.Millisecond * 50
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse, delay: serverDelay}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	result, err := (&Client{}).Do(parsedURL, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timings := result.Timings
+	// The mock server listens on an IP address so no lookup is required
+	if timings.DNSLookup != 0 || timings.TLSHandshake != 0 {
+		t.Errorf("expected DNS lookup and TLS handshake to be skipped: %+v\n", timings)
+	}
+	if timings.Connect <= 0 {
+		t.Errorf("expected connect time to be recorded: %+v\n", timings)
+	}
+	if timings.FirstByte < serverDelay {
+		t.Errorf("expected time to first byte of at least %v got %v\n", serverDelay, timings.FirstByte)
+	}
+
+	results := &ProfileResults{Latency: LatencyOptions{Exact: true}}
+	results.Init(1)
+	results.RecordTimings(timings)
+	results.RecordTimings(PhaseTimings{Connect: 3 * timings.Connect})
+	if results.DNSLookup.Count != 0 || results.Connect.Count != 2 || results.FirstByte.Count != 1 {
+		t.Errorf("unexpected phase counts: %+v\n", results)
+	}
+	if results.Connect.Max != 3*timings.Connect {
+		t.Errorf("expected max connect time %v got %v\n", 3*timings.Connect, results.Connect.Max)
+	}
+	if results.Connect.Median() != 2*timings.Connect {
+		t.Errorf("expected median connect time %v got %v\n", 2*timings.Connect, results.Connect.Median())
+	}
+
+	// By default phase times are recorded in a histogram with three significant
+	// digits, whose nearest-rank median is the lower of the two times
+	histogram := &ProfileResults{}
+	histogram.Init(1)
+	histogram.RecordTimings(timings)
+	histogram.RecordTimings(PhaseTimings{Connect: 3 * timings.Connect})
+	if histogram.Connect.times != nil {
+		t.Errorf("expected phase times not to be kept: %v\n", histogram.Connect.times)
+	}
+	median := histogram.Connect.Median()
+	if median < timings.Connect || median > timings.Connect+timings.Connect/1000+time.Microsecond {
+		t.Errorf("expected median connect time close to %v got %v\n", timings.Connect, median)
+	}
+	if histogram.DNSLookup.Median() != 0 {
+		t.Errorf("expected no median for a skipped phase got %v\n", histogram.DNSLookup.Median())
+	}
+}
+
+func TestProfileReportJSON(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	serverResponse := [][]string{{"HTTP/1.1 200 OK\r\n", "\r\n"}, {"HTTP/1.1 404 Not Found\r\n", "\r\n"}}
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	results := DoProfile(ProfileOptions{Repetitions: 4}, parsedURL, nil)
+	results.Percentiles = []float64{99.9}
+	encoded, err := results.JSON(parsedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ProfileReport
+	if err := json.Unmarshal(encoded, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Version != ProfileReportVersion || report.URL != parsedURL.String() {
+		t.Errorf("unexpected report header: version %d url %s\n", report.Version, report.URL)
+	}
+	if report.Requests != 4 || report.FailedRequests != 2 {
+		t.Errorf("expected 4 requests and 2 failures got %d and %d\n", report.Requests, report.FailedRequests)
+	}
+	if report.StatusCodes["200"] != 2 || report.StatusCodes["404"] != 2 {
+		t.Errorf("unexpected status codes: %v\n", report.StatusCodes)
+	}
+	if _, ok := report.Latency.Percentiles["p99.9"]; !ok {
+		t.Errorf("expected p99.9 in report percentiles: %v\n", report.Latency.Percentiles)
+	}
+	if !report.EndTime.After(report.StartTime) {
+		t.Errorf("expected end time %v after start time %v\n", report.EndTime, report.StartTime)
+	}
+}
+
+// Every request in a profile should produce one line in the trace log
+func TestProfileTraceLog(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	serverResponse := [][]string{{"HTTP/1.1 200 OK\r\n", "\r\n"}, {"Jockey go fast\r\n", "\r\n"}}
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	var traceLog bytes.Buffer
+	reps := 6
+	DoProfile(ProfileOptions{Repetitions: reps, Concurrency: 2, TraceLog: &traceLog}, parsedURL, nil)
+	decoder := json.NewDecoder(&traceLog)
+	var records []traceRecord
+	for decoder.More() {
+		var record traceRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != reps {
+		t.Fatalf("expected %d trace records got %d\n", reps, len(records))
+	}
+	failed := 0
+	for _, record := range records {
+		if record.Worker < 0 || record.Worker > 1 {
+			t.Errorf("unexpected worker id %d\n", record.Worker)
+		}
+		if record.Error != "" {
+			failed++
+		} else if record.Status != 200 || record.BytesRead == 0 {
+			t.Errorf("unexpected successful record: %+v\n", record)
+		}
+	}
+	if failed != reps/2 {
+		t.Errorf("expected %d failed requests in trace log got %d\n", reps/2, failed)
+	}
+}
+
+// Keep-alive connections should be reused for responses framed by either
+// Content-Length or chunked transfer coding
+func TestKeepAlive(t *testing.T) {
+	body := "Jockey go fast"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// Flushing before the handler returns forces a chunked response
+			for _, word := range strings.SplitAfter(body, " ") {
+				fmt.Fprint(w, word)
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	client := &Client{KeepAlive: true}
+	opened, reused := 0, 0
+	for i := 0; i < 6; i++ {
+		path := "/"
+		if i%2 == 1 {
+			path = "/chunked"
+		}
+		requestURL, err := url.Parse(server.URL + path)
+		if err != nil {
+			t.Fatal("error parsing test server url")
+		}
+		var buf bytes.Buffer
+		result, err := client.Do(requestURL, &buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != body {
+			t.Errorf("%s: expected body %q got %q\n", path, body, buf.String())
+		}
+		opened += result.ConnectionsOpened
+		reused += result.ConnectionsReused
+	}
+	if opened != 1 || reused != 5 {
+		t.Errorf("expected 1 connection opened and 5 reused got %d and %d\n", opened, reused)
+	}
+}
+
+// A request sent over an idle connection that the server has since closed should
+// be retried on a new connection
+func TestKeepAliveStaleConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	// The mock server closes every connection after responding even though the
+	// response does not ask the client to close it
+	serverResponse := [][]string{{"HTTP/1.1 200 OK\r\n", "Content-Length: 2\r\n", "\r\n", "ok"}}
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	client := &Client{KeepAlive: true}
+	for i := 0; i < 3; i++ {
+		result, err := client.Do(parsedURL, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ConnectionsOpened != 1 || result.ConnectionsReused != 0 {
+			t.Errorf("expected a single new connection got %d opened and %d reused\n",
+				result.ConnectionsOpened, result.ConnectionsReused)
+		}
+		if expectedLen := ms.responseLengths()[0]; result.BytesRead != expectedLen {
+			t.Errorf("expected %d bytes read, got %d\n", expectedLen, result.BytesRead)
+		}
+	}
+}
+
+// Chunk sizes, extensions and trailers should be stripped from chunked bodies
+// and invalid framing reported as a ChunkedEncodingError
+func TestChunkedResponses(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	chunkedHeaders := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	serverResponse := [][]string{
+		{chunkedHeaders, "7\r\nJockey \r\n", "3;ext=1\r\ngo \r\n", "4\r\nfast\r\n",
+			"0\r\n", "Checksum: abc\r\n", "\r\n"},
+		{chunkedHeaders, "zz\r\nJockey\r\n0\r\n\r\n"},
+		{chunkedHeaders, "2\r\nJockey\r\n0\r\n\r\n"},
+		{chunkedHeaders, "6\r\nJock"},
+	}
+	ms := &mockServer{listener: listener.(*net.TCPListener), responses: serverResponse}
+	go ms.start(t)
+
+	parsedURL, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal("error parsing mock server url")
+	}
+	var buf bytes.Buffer
+	result, err := (&Client{}).Do(parsedURL, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "Jockey go fast" {
+		t.Errorf("expected decoded body %q got %q\n", "Jockey go fast", buf.String())
+	}
+	if result.Trailer.Get("Checksum") != "abc" {
+		t.Errorf("expected trailer Checksum: abc got %v\n", result.Trailer)
+	}
+	// Bad chunk size and missing CRLF after the chunk data
+	for i := 0; i < 2; i++ {
+		_, err = (&Client{}).Do(parsedURL, ioutil.Discard, nil)
+		if ClassifyError(err) != ErrorChunkedEncoding {
+			t.Errorf("expected chunked encoding error got %v\n", err)
+		}
+	}
+	// A truncated chunk is a broken connection rather than bad framing
+	_, err = (&Client{}).Do(parsedURL, ioutil.Discard, nil)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF got %v\n", err)
+	}
+}
+
+// Request bodies should be sent with a Content-Length header and responses to
+// HEAD requests should be treated as having no body
+func TestMethodsAndBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.Method)+1+len(received)))
+		fmt.Fprintf(w, "%s %s", r.Method, received)
+	}))
+	defer server.Close()
+	requestURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+
+	bodyFile, err := ioutil.TempFile("", "jockey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bodyFile.Name())
+	fmt.Fprint(bodyFile, "from a file")
+	bodyFile.Close()
+	fileBody, err := NewFileBody(bodyFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method   string
+		body     RequestBody
+		expected string
+	}{
+		{"POST", BytesBody("Jockey go fast"), "POST Jockey go fast"},
+		{"PUT", fileBody, "PUT from a file"},
+		{"DELETE", nil, "DELETE "},
+		{"HEAD", nil, ""},
+		{"PATCH", fileBody, "PATCH from a file"},
+	}
+	client := &Client{KeepAlive: true}
+	for _, testCase := range cases {
+		client.Method = testCase.method
+		client.Body = testCase.body
+		var buf bytes.Buffer
+		result, err := client.Do(requestURL, &buf, nil)
+		if err != nil {
+			t.Fatalf("%s: %s\n", testCase.method, err)
+		}
+		if result.Status != 200 || buf.String() != testCase.expected {
+			t.Errorf("%s: expected 200 %q got %d %q\n",
+				testCase.method, testCase.expected, result.Status, buf.String())
+		}
+	}
+}
+
+// Caller headers should replace defaults with the same name and be sent in the
+// order given, including repeated names
+func TestSendRequestHeaders(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	requestURL, _ := url.Parse("http://www.example.com:80/path?q=1")
+	headers := Header{
+		{"X-Trace", "1"},
+		{"user-agent", "Jockey"},
+		{"X-Trace", "2"},
+	}
+	go func() {
+		_ = SendRequest(client, "GET", requestURL, headers, nil)
+		client.Close()
+	}()
+	tp := textproto.NewReader(bufio.NewReader(server))
+	var lines []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil || line == "" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	expected := []string{
+		"GET /path?q=1 HTTP/1.1",
+		"Host: www.example.com:80",
+		"Accept: */*",
+		"Accept-Encoding: identity",
+		"Connection: close",
+		"X-Trace: 1",
+		"user-agent: Jockey",
+		"X-Trace: 2",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("unexpected request:\ngot:      %q\nexpected: %q\n", lines, expected)
+	}
+}
+
+func TestParseHeaderField(t *testing.T) {
+	cases := []struct {
+		raw         string
+		expected    HeaderField
+		expectError bool
+	}{
+		{"Accept: text/html", HeaderField{"Accept", "text/html"}, false},
+		{"X-Empty:", HeaderField{"X-Empty", ""}, false},
+		{"Authorization:  Bearer a:b ", HeaderField{"Authorization", "Bearer a:b"}, false},
+		{"No colon", HeaderField{}, true},
+		{": no name", HeaderField{}, true},
+		{"Bad Name: value", HeaderField{}, true},
+	}
+	for _, testCase := range cases {
+		got, err := ParseHeaderField(testCase.raw)
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("expected error parsing header %q\n", testCase.raw)
+			}
+			continue
+		}
+		if err != nil || got != testCase.expected {
+			t.Errorf("parsing header %q: got %+v, %v expected %+v\n", testCase.raw, got, err, testCase.expected)
+		}
+	}
+}
+
+// Server certificates should be verified unless verification is disabled, and
+// verification failures should be counted as their own class of error
+func TestTLSVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Jockey go fast")
+	}))
+	defer server.Close()
+	requestURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+
+	// The test server's certificate is not signed by a trusted root
+	results := DoProfile(ProfileOptions{Repetitions: 2}, requestURL, nil)
+	if results.ErrorClassCounts[ErrorTLSVerify] != 2 {
+		t.Errorf("expected 2 certificate verification failures got %v\n", results.ErrorClassCounts)
+	}
+
+	insecure, err := LoadTLSConfig(true, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Client{TLSConfig: insecure}).Do(requestURL, ioutil.Discard, nil); err != nil {
+		t.Errorf("insecure request failed: %s\n", err)
+	}
+
+	// Trust the test server's certificate through a CA bundle
+	caFile, err := ioutil.TempFile("", "jockey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	_ = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile.Close()
+	verified, err := LoadTLSConfig(false, caFile.Name(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := (&Client{TLSConfig: verified}).Do(requestURL, &buf, nil); err != nil {
+		t.Errorf("request with custom CA bundle failed: %s\n", err)
+	}
+	if buf.String() != "Jockey go fast" {
+		t.Errorf("expected body %q got %q\n", "Jockey go fast", buf.String())
+	}
+}
+
+func TestTLSInfo(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	requestURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+	insecure, _ := LoadTLSConfig(true, "", "", "")
+	result, err := (&Client{TLSConfig: insecure}).Do(requestURL, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TLS == nil {
+		t.Fatal("expected TLS connection state for https request")
+	}
+	info := FormatTLSInfo(result.TLS)
+	for _, expected := range []string{"TLS 1.3", "Session resumed:  no", "example.com", "127.0.0.1"} {
+		if !strings.Contains(info, expected) {
+			t.Errorf("expected TLS info to contain %q\n", expected)
+		}
+	}
+
+	// The chain is kept when it fails verification
+	_, err = (&Client{}).Do(requestURL, ioutil.Discard, nil)
+	var handshakeErr *TLSHandshakeError
+	if !errors.As(err, &handshakeErr) || len(handshakeErr.PeerCertificates) == 0 {
+		t.Fatalf("expected handshake error with the server's certificates, got %v\n", err)
+	}
+	if chain := FormatCertificateChain(handshakeErr.PeerCertificates); !strings.Contains(chain, "example.com") {
+		t.Errorf("expected certificate chain to contain example.com, got %q\n", chain)
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	requestURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+	config, _ := LoadTLSConfig(true, "", "", "")
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	client := &Client{TLSConfig: config}
+	results := DoProfile(ProfileOptions{Repetitions: 5, CompareHandshakes: true}, requestURL, client)
+	if results.FailedRequests != 0 {
+		t.Fatalf("expected no failed requests, got %d\n", results.FailedRequests)
+	}
+	// Only the first connection has no session to resume
+	if results.FullHandshake.Count != 1 || results.ResumedHandshake.Count != 4 {
+		t.Errorf("expected 1 full and 4 resumed handshakes, got %d and %d\n",
+			results.FullHandshake.Count, results.ResumedHandshake.Count)
+	}
+	if results.TLSHandshake.Count != 5 {
+		t.Errorf("expected 5 TLS handshakes, got %d\n", results.TLSHandshake.Count)
+	}
+	output := results.String()
+	for _, expected := range []string{"Full:", "Resumed:"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected results to contain %q\n", expected)
+		}
+	}
+
+	// A redirected request may perform a full handshake and a resumed one
+	mixed := &ProfileResults{}
+	mixed.Init(1)
+	mixed.RecordTimings(PhaseTimings{TLSHandshake: 5 * time.Millisecond,
+		ResumedTLSHandshake: 2 * time.Millisecond})
+	if mixed.FullHandshake.Max != 3*time.Millisecond ||
+		mixed.ResumedHandshake.Max != 2*time.Millisecond {
+		t.Errorf("expected 3ms full and 2ms resumed handshakes, got %v and %v\n",
+			mixed.FullHandshake.Max, mixed.ResumedHandshake.Max)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		received, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, received)
+	})
+	for _, code := range []int{301, 302, 303, 307, 308} {
+		code := code
+		mux.HandleFunc(fmt.Sprintf("/%d", code), func(w http.ResponseWriter, r *http.Request) {
+			// Relative to the request URL
+			w.Header().Set("Location", "final")
+			w.WriteHeader(code)
+			fmt.Fprint(w, "redirect body")
+		})
+	}
+	mux.HandleFunc("/chain", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/302", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop?again", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	base, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+
+	cases := []struct {
+		path     string
+		method   string
+		expected string
+		hops     int
+	}{
+		{"/301", "POST", "GET ", 2},
+		{"/302", "POST", "GET ", 2},
+		{"/302", "PUT", "PUT Jockey go fast", 2},
+		{"/303", "PUT", "GET ", 2},
+		{"/307", "POST", "POST Jockey go fast", 2},
+		{"/308", "PUT", "PUT Jockey go fast", 2},
+		{"/chain", "POST", "GET ", 3},
+		{"/final", "POST", "POST Jockey go fast", 1},
+	}
+	client := &Client{Body: BytesBody("Jockey go fast"), FollowRedirects: true, MaxRedirects: 10}
+	for _, testCase := range cases {
+		client.Method = testCase.method
+		var buf bytes.Buffer
+		result, err := client.Do(base.ResolveReference(&url.URL{Path: testCase.path}), &buf, nil)
+		if err != nil {
+			t.Fatalf("%s %s: %s\n", testCase.method, testCase.path, err)
+		}
+		if result.Status != 200 || buf.String() != testCase.expected {
+			t.Errorf("%s %s: expected 200 %q got %d %q\n", testCase.method, testCase.path,
+				testCase.expected, result.Status, buf.String())
+		}
+		if len(result.Hops) != testCase.hops {
+			t.Errorf("%s %s: expected %d hops, got %d\n", testCase.method, testCase.path,
+				testCase.hops, len(result.Hops))
+		}
+		if result.ConnectionsOpened != testCase.hops {
+			t.Errorf("%s %s: expected a connection per hop, got %d\n", testCase.method,
+				testCase.path, result.ConnectionsOpened)
+		}
+	}
+
+	client = &Client{FollowRedirects: true, MaxRedirects: 10}
+	_, err = client.Do(base.ResolveReference(&url.URL{Path: "/loop"}), ioutil.Discard, nil)
+	if ClassifyError(err) != ErrorRedirect || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("expected redirect loop error, got %v\n", err)
+	}
+	client.MaxRedirects = 1
+	result, err := client.Do(base.ResolveReference(&url.URL{Path: "/chain"}), ioutil.Discard, nil)
+	if ClassifyError(err) != ErrorRedirect || result.Status != 302 {
+		t.Errorf("expected redirect limit error after a 302, got %d %v\n", result.Status, err)
+	}
+	client.FollowRedirects = false
+	result, err = client.Do(base.ResolveReference(&url.URL{Path: "/chain"}), ioutil.Discard, nil)
+	if err != nil || result.Status != 302 || len(result.Hops) != 0 {
+		t.Errorf("expected unfollowed 302, got %d %v\n", result.Status, err)
+	}
+
+	client.FollowRedirects = true
+	client.MaxRedirects = 10
+	results := DoProfile(ProfileOptions{Repetitions: 3}, base.ResolveReference(&url.URL{Path: "/chain"}),
+		client)
+	if len(results.Hops) != 3 || results.Hops[2].Count != 3 {
+		t.Errorf("expected 3 requests through 3 hops, got %+v\n", results.Hops)
+	}
+	if !strings.Contains(results.String(), "Hop 3:") {
+		t.Error("expected hop times in results")
+	}
+}
+
+// Authorization, Cookie and Host headers set by the caller should only follow
+// redirects that stay on the same host and scheme
+func TestRedirectHeaders(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s|%s", r.Header.Get("Authorization"), r.Header.Get("Cookie"),
+			r.Host, r.Header.Get("X-Trace"))
+	}
+	var serverURL string
+	otherMux := http.NewServeMux()
+	otherMux.HandleFunc("/echo", echo)
+	otherMux.HandleFunc("/return", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, serverURL+"/echo", http.StatusFound)
+	})
+	other := httptest.NewServer(otherMux)
+	defer other.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", echo)
+	mux.HandleFunc("/same", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/echo", http.StatusFound)
+	})
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/echo", http.StatusFound)
+	})
+	mux.HandleFunc("/back", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/return", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverURL = server.URL
+	base, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+
+	client := &Client{FollowRedirects: true, MaxRedirects: 10, Headers: Header{
+		{"Authorization", "Bearer secret"},
+		{"cookie", "session=1"},
+		{"Host", "jockey.test"},
+		{"X-Trace", "1"},
+	}}
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/same", "Bearer secret|session=1|jockey.test|1"},
+		{"/away", "||" + strings.TrimPrefix(other.URL, "http://") + "|1"},
+		// Headers are not restored on returning to the original host
+		{"/back", "||" + base.Host + "|1"},
+	}
+	for _, testCase := range cases {
+		var buf bytes.Buffer
+		_, err := client.Do(base.ResolveReference(&url.URL{Path: testCase.path}), &buf, nil)
+		if err != nil {
+			t.Fatalf("%s: %s\n", testCase.path, err)
+		}
+		if buf.String() != testCase.expected {
+			t.Errorf("%s: expected %q got %q\n", testCase.path, testCase.expected, buf.String())
+		}
+	}
+	if len(client.Headers) != 4 || client.Headers[0].Value != "Bearer secret" {
+		t.Errorf("expected the client's headers to be left unchanged: %v\n", client.Headers)
+	}
+}
+
+// ReadResponse should return the header fields of the final response in the order
+// they were received, skipping any interim responses
+func TestResponseHeaders(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		fmt.Fprint(server, "HTTP/1.1 100 Continue\r\nX-Interim: 1\r\n\r\n"+
+			"HTTP/1.1 200 OK\r\nX-B: 2\r\nx-a: 1\r\nX-B: 3\r\nContent-Length: 2\r\n\r\nhi")
+	}()
+	var buf bytes.Buffer
+	status, header, _, err := ReadResponse(client, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Header{{"X-B", "2"}, {"x-a", "1"}, {"X-B", "3"}, {"Content-Length", "2"}}
+	if status != 200 || !reflect.DeepEqual(header, expected) || buf.String() != "hi" {
+		t.Errorf("expected 200 %v \"hi\", got %d %v %q\n", expected, status, header, buf.String())
+	}
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+		fmt.Fprint(w, "body")
+	}))
+	defer httpServer.Close()
+	requestURL, err := url.Parse(httpServer.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+	var head strings.Builder
+	buf.Reset()
+	result, err := (&Client{HeadWriter: &head}).Do(requestURL, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Header.Get("X-Cache") != "HIT" || buf.String() != "body" {
+		t.Errorf("expected X-Cache header and body, got %v %q\n", result.Header, buf.String())
+	}
+	if !strings.HasPrefix(head.String(), "HTTP/1.1 200 OK\r\n") ||
+		!strings.Contains(head.String(), "X-Cache: HIT\r\n") ||
+		!strings.HasSuffix(head.String(), "\r\n\r\n") {
+		t.Errorf("unexpected response head %q\n", head.String())
+	}
+}
+
+func TestCompressedResponses(t *testing.T) {
+	expected := strings.Repeat("Jockey go fast. ", 1000)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip, deflate" {
+			fmt.Fprint(w, expected)
+			return
+		}
+		var buf bytes.Buffer
+		var compressor io.WriteCloser
+		switch r.URL.Path {
+		case "/gzip":
+			compressor = gzip.NewWriter(&buf)
+			w.Header().Set("Content-Encoding", "gzip")
+		case "/zlib":
+			compressor = zlib.NewWriter(&buf)
+			w.Header().Set("Content-Encoding", "deflate")
+		case "/flate":
+			compressor, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+			w.Header().Set("Content-Encoding", "deflate")
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			fmt.Fprint(w, "not really brotli")
+			return
+		case "/empty":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", "0")
+			return
+		case "/nocontent":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(compressor, expected)
+		compressor.Close()
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		}
+		w.Write(buf.Bytes())
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	base, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+
+	client := &Client{Compressed: true, KeepAlive: true}
+	for _, path := range []string{"/gzip", "/zlib", "/flate", "/gzip?chunked=1"} {
+		requestURL, _ := base.Parse(path)
+		var buf bytes.Buffer
+		result, err := client.Do(requestURL, &buf, nil)
+		if err != nil {
+			t.Fatalf("%s: %s\n", path, err)
+		}
+		if buf.String() != expected || result.BodyBytes != len(expected) {
+			t.Errorf("%s: expected %d decoded bytes, got %d\n", path, len(expected), result.BodyBytes)
+		}
+		if result.BytesRead >= len(expected) {
+			t.Errorf("%s: expected fewer than %d bytes read, got %d\n", path, len(expected),
+				result.BytesRead)
+		}
+	}
+	// An empty body has nothing to decode
+	for _, path := range []string{"/empty", "/nocontent"} {
+		requestURL, _ := base.Parse(path)
+		if result, err := client.Do(requestURL, ioutil.Discard, nil); err != nil ||
+			result.BodyBytes != 0 {
+			t.Errorf("%s: expected empty gzip response to succeed, got %v\n", path, err)
+		}
+	}
+	// Every response should have left the connection ready for the next request
+	if client.pool.get(poolKey(base)) == nil {
+		t.Error("expected an idle connection after compressed responses")
+	}
+	requestURL, _ := base.Parse("/br")
+	if _, err := client.Do(requestURL, ioutil.Discard, nil); err == nil {
+		t.Error("expected an error for an unsupported content coding")
+	}
+
+	// The same holds for HTTP/2, and the head is written even if the body cannot
+	// be decoded
+	h2cServer := httptest.NewUnstartedServer(handler)
+	h2cServer.Config.Protocols = new(http.Protocols)
+	h2cServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cServer.Start()
+	defer h2cServer.Close()
+	h2Base, _ := url.Parse(h2cServer.URL)
+	var head bytes.Buffer
+	h2Client := &Client{Compressed: true, HTTP2: true, HeadWriter: &head}
+	for _, path := range []string{"/gzip", "/empty", "/nocontent"} {
+		requestURL, _ := h2Base.Parse(path)
+		var buf bytes.Buffer
+		result, err := h2Client.Do(requestURL, &buf, nil)
+		if path == "/gzip" && buf.String() != expected || err != nil ||
+			result.BodyBytes != buf.Len() {
+			t.Errorf("%s: expected HTTP/2 response to be decoded, got %d bytes %v\n", path,
+				result.BodyBytes, err)
+		}
+	}
+	head.Reset()
+	requestURL, _ = h2Base.Parse("/br")
+	if _, err := h2Client.Do(requestURL, ioutil.Discard, nil); err == nil ||
+		!strings.Contains(head.String(), "content-encoding: br") {
+		t.Errorf("expected HTTP/2 head before unsupported content coding error, got %q %v\n",
+			head.String(), err)
+	}
+	head.Reset()
+	client.HeadWriter = &head
+	requestURL, _ = base.Parse("/br")
+	if _, err := client.Do(requestURL, ioutil.Discard, nil); err == nil ||
+		!strings.Contains(head.String(), "Content-Encoding: br") {
+		t.Errorf("expected head before unsupported content coding error, got %q %v\n",
+			head.String(), err)
+	}
+
+	var buf bytes.Buffer
+	result, err := (&Client{}).Do(base, &buf, nil)
+	if err != nil || buf.String() != expected || result.BytesRead < len(expected) {
+		t.Errorf("expected uncompressed response without -compressed, got %v\n", err)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Proto", r.Proto)
+		// Hold each stream open briefly so that concurrent requests overlap
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, "%s %s", r.Method, received)
+	})
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	h2cServer := httptest.NewUnstartedServer(handler)
+	h2cServer.Config.Protocols = new(http.Protocols)
+	h2cServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cServer.Start()
+	defer h2cServer.Close()
+
+	insecure, _ := LoadTLSConfig(true, "", "", "")
+	for _, server := range []*httptest.Server{tlsServer, h2cServer} {
+		requestURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal("error parsing test server url")
+		}
+		client := &Client{Method: "POST", Body: BytesBody("Jockey go fast"), TLSConfig: insecure,
+			HTTP2: true}
+		var buf bytes.Buffer
+		result, err := client.Do(requestURL, &buf, nil)
+		if err != nil {
+			t.Fatalf("%s: %s\n", server.URL, err)
+		}
+		if result.Status != 200 || buf.String() != "POST Jockey go fast" ||
+			result.Header.Get("X-Proto") != "HTTP/2.0" {
+			t.Errorf("%s: expected HTTP/2 200 \"POST Jockey go fast\", got %d %q %v\n",
+				server.URL, result.Status, buf.String(), result.Header)
+		}
+		if result.Timings.Stream <= 0 || result.Timings.Connect <= 0 {
+			t.Errorf("%s: expected stream and connect timings, got %+v\n", server.URL, result.Timings)
+		}
+
+		client.Method = "GET"
+		client.Body = nil
+		results := DoProfile(ProfileOptions{Repetitions: 20, Concurrency: 10}, requestURL, client)
+		if results.FailedRequests != 0 {
+			t.Errorf("%s: expected no failed requests, got %d\n", server.URL, results.FailedRequests)
+		}
+		// The first request's connection already carries every later stream
+		if results.ConnectionsOpened != 0 || results.ConnectionsReused != 20 {
+			t.Errorf("%s: expected 20 streams over the existing connection, got %d opened %d reused\n",
+				server.URL, results.ConnectionsOpened, results.ConnectionsReused)
+		}
+		if results.Stream.Count != 20 {
+			t.Errorf("%s: expected 20 stream times, got %d\n", server.URL, results.Stream.Count)
+		}
+
+		// Both https and h2c requests are tunnelled through HTTP proxies
+		proxy := startHTTPProxy(t, "")
+		client.Proxy, _ = ParseProxyURL("http://" + proxy.Listener.Addr().String())
+		buf.Reset()
+		result, err = client.Do(requestURL, &buf, nil)
+		proxy.Close()
+		if err != nil || buf.String() != "GET " || result.Header.Get("X-Proto") != "HTTP/2.0" {
+			t.Errorf("%s: expected HTTP/2 response through proxy, got %q %v %v\n", server.URL,
+				buf.String(), result.Header, err)
+		}
+	}
+
+	// HTTP/2 is required once it has been asked for
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	requestURL, _ := url.Parse(server.URL)
+	if _, err := (&Client{HTTP2: true}).Do(requestURL, ioutil.Discard, nil); err == nil {
+		t.Error("expected HTTP/2 request to an HTTP/1.1 server to fail")
+	}
+}
+
+// startHTTPProxy starts an HTTP proxy that tunnels CONNECT requests and answers
+// forwarded requests itself with the URL it was asked for
+func startHTTPProxy(t *testing.T, auth string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != "CONNECT" {
+			fmt.Fprintf(w, "proxied %s", r.URL)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(target, conn)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+}
+
+// startSOCKS5Proxy starts a SOCKS5 proxy that requires the given username and
+// password and records the addresses it is asked to connect to
+func startSOCKS5Proxy(t *testing.T, username, password string, targets chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		// Greeting and username/password authentication
+		io.ReadFull(conn, buf[:2])
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{5, 2})
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+		// Connect request
+		io.ReadFull(conn, buf[:4])
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 3:
+			io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		}
+		io.ReadFull(conn, buf[:2])
+		address := net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+		targets <- address
+		target, err := net.Dial("tcp", address)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener
+}
+
+func TestProxy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "direct")
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+	insecure, _ := LoadTLSConfig(true, "", "", "")
+
+	httpProxy := startHTTPProxy(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("jockey:fast")))
+	defer httpProxy.Close()
+	proxyURL, err := ParseProxyURL("http://jockey:fast@" + httpProxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{TLSConfig: insecure, Proxy: proxyURL}
+	var buf bytes.Buffer
+	result, err := client.Do(serverURL, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "direct" || result.Timings.ProxyConnect <= 0 {
+		t.Errorf("expected response through CONNECT tunnel, got %q %+v\n", buf.String(), result.Timings)
+	}
+	// Plain HTTP requests are forwarded by the proxy in absolute-form. The proxy
+	// credentials must not be written into spare capacity of the shared headers.
+	client.Headers = make(Header, 1, 2)
+	client.Headers[0] = HeaderField{"X-Trace", "1"}
+	plainURL, _ := url.Parse("http://example.com:80/path?q=1")
+	buf.Reset()
+	result, err = client.Do(plainURL, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "proxied http://example.com:80/path?q=1" || result.Timings.ProxyConnect != 0 {
+		t.Errorf("expected forwarded request, got %q\n", buf.String())
+	}
+	if spare := client.Headers[:2][1]; spare != (HeaderField{}) {
+		t.Errorf("expected client headers to be left unchanged, found %v\n", spare)
+	}
+	client.Headers = nil
+	client.Proxy, _ = ParseProxyURL("http://jockey:slow@" + httpProxy.Listener.Addr().String())
+	_, err = client.Do(serverURL, ioutil.Discard, nil)
+	if ClassifyError(err) != ErrorProxy || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected CONNECT to fail with 407, got %v\n", err)
+	}
+
+	targets := make(chan string, 1)
+	socksProxy := startSOCKS5Proxy(t, "jockey", "fast", targets)
+	defer socksProxy.Close()
+	client.Proxy, _ = ParseProxyURL("socks5://jockey:fast@" + socksProxy.Addr().String())
+	localURL, _ := url.Parse("https://localhost:" + serverURL.Port())
+	buf.Reset()
+	result, err = client.Do(localURL, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "direct" || result.Timings.ProxyConnect <= 0 {
+		t.Errorf("expected response through SOCKS5 proxy, got %q %+v\n", buf.String(), result.Timings)
+	}
+	// Host names are resolved by the proxy
+	if target := <-targets; target != localURL.Host {
+		t.Errorf("expected SOCKS5 proxy to connect to %s, got %s\n", localURL.Host, target)
+	}
+	// Address overrides change the target of the tunnel rather than the proxy
+	_, proxyPort, _ := net.SplitHostPort(socksProxy.Addr().String())
+	client.ConnectTo = []ConnectTo{{Port: proxyPort, ToPort: "1"}}
+	client.Resolve = map[string][]string{
+		"jockey.test:" + serverURL.Port(): {"127.0.0.1:" + serverURL.Port()}}
+	overriddenURL, _ := url.Parse("https://jockey.test:" + serverURL.Port())
+	if _, err := client.Do(overriddenURL, ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	if target := <-targets; target != "127.0.0.1:"+serverURL.Port() {
+		t.Errorf("expected SOCKS5 proxy to connect to the resolved address, got %s\n", target)
+	}
+	client.ConnectTo, client.Resolve = nil, nil
+	client.Proxy, _ = ParseProxyURL("socks5://jockey:slow@" + socksProxy.Addr().String())
+	_, err = client.Do(serverURL, ioutil.Discard, nil)
+	if ClassifyError(err) != ErrorProxy {
+		t.Errorf("expected SOCKS5 authentication to fail, got %v\n", err)
+	}
+
+	for _, rawURL := range []string{"https://proxy:3128", "ftp://proxy", "http://"} {
+		if _, err := ParseProxyURL(rawURL); err == nil {
+			t.Errorf("expected error parsing proxy URL %s\n", rawURL)
+		}
+	}
+	if parsed, _ := ParseProxyURL("socks5://proxy"); parsed.Host != "proxy:1080" {
+		t.Errorf("expected default proxy port 1080, got %s\n", parsed.Host)
+	}
+}
+
+func TestResolveAndConnectTo(t *testing.T) {
+	var mu sync.Mutex
+	served := map[string]int{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local := r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()
+		mu.Lock()
+		served[local]++
+		mu.Unlock()
+		fmt.Fprint(w, r.Host)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	port := first.Listener.Addr().(*net.TCPAddr).Port
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.2:%d", port))
+	if err != nil {
+		t.Skip("cannot listen on 127.0.0.2:", err)
+	}
+	second := &httptest.Server{Listener: listener, Config: &http.Server{Handler: handler}}
+	second.Start()
+	defer second.Close()
+
+	hostPort, addresses, err := ParseResolve(fmt.Sprintf("Jockey.Test:%d:127.0.0.1,[127.0.0.2]", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestURL, _ := url.Parse(fmt.Sprintf("http://jockey.test:%d/", port))
+	client := &Client{Resolve: map[string][]string{hostPort: addresses}}
+	var buf bytes.Buffer
+	_, err = client.Do(requestURL, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != requestURL.Host {
+		t.Errorf("expected Host header %s, got %s\n", requestURL.Host, buf.String())
+	}
+	results := DoProfile(ProfileOptions{Repetitions: 3}, requestURL, client)
+	if results.FailedRequests != 0 {
+		t.Fatalf("expected no failed requests, got %d\n", results.FailedRequests)
+	}
+	mu.Lock()
+	if len(served) != 2 || served[first.Listener.Addr().String()] != 2 ||
+		served[listener.Addr().String()] != 2 {
+		t.Errorf("expected requests spread round-robin across both addresses, got %v\n", served)
+	}
+	mu.Unlock()
+
+	override, err := ParseConnectTo(fmt.Sprintf("jockey.test::127.0.0.2:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &Client{ConnectTo: []ConnectTo{override}}
+	buf.Reset()
+	otherURL, _ := url.Parse("http://jockey.test:1234/")
+	_, err = client.Do(otherURL, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != otherURL.Host || served[listener.Addr().String()] != 3 {
+		t.Errorf("expected request for %s at the second server, got %s\n", otherURL.Host, buf.String())
+	}
+
+	for _, value := range []string{"host:80", "host:80:not-an-ip", "host:http:127.0.0.1", ":80:127.0.0.1"} {
+		if _, _, err := ParseResolve(value); err == nil {
+			t.Errorf("expected error parsing resolve %q\n", value)
+		}
+	}
+	for _, value := range []string{"host:80:other", "host:80:other:80:extra", "[::1:80::"} {
+		if _, err := ParseConnectTo(value); err == nil {
+			t.Errorf("expected error parsing connect-to %q\n", value)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jockey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sidecar.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("cannot listen on a Unix domain socket:", err)
+	}
+	server := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Host, r.URL.RequestURI())
+		})},
+	}
+	server.Start()
+	defer server.Close()
+
+	// Count the connections opened through the Dialer
+	var dials int32
+	dialer := DialerFunc(func(ctx context.Context, address string, timings *PhaseTimings) (
+		net.Conn, error) {
+
+		atomic.AddInt32(&dials, 1)
+		return UnixDialer{Path: path}.Dial(ctx, address, timings)
+	})
+	requestURL, _ := url.Parse("http://service.internal:80/status?verbose=1")
+	for _, client := range []*Client{{Dialer: dialer}, {Dialer: dialer, KeepAlive: true}} {
+		var buf bytes.Buffer
+		result, err := client.Do(requestURL, &buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != "service.internal:80 /status?verbose=1" {
+			t.Errorf("expected Host header and request URI from URL, got %q\n", buf.String())
+		}
+		if result.Timings.Connect <= 0 || result.Timings.DNSLookup != 0 {
+			t.Errorf("expected connect time without DNS lookup, got %+v\n", result.Timings)
+		}
+	}
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Errorf("expected 2 connections through the dialer, got %d\n", dials)
+	}
+}
+
+// Requests exceeding one of the Client's timeouts should fail with a TimeoutError
+// naming the phase and be counted as timeouts in profiles
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Write([]byte("Jockey go "))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+	defer close(release)
+
+	// Accept TCP connections but never answer the TLS handshake
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		var accepted []net.Conn
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				for _, conn := range accepted {
+					conn.Close()
+				}
+				return
+			}
+			accepted = append(accepted, conn)
+		}
+	}()
+
+	// A proxy that never answers requests for a tunnel
+	silentProxy, _ := ParseProxyURL("http://" + silent.Addr().String())
+
+	// Never finish connecting
+	blackhole := DialerFunc(func(ctx context.Context, address string, timings *PhaseTimings) (
+		net.Conn, error) {
+
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: ctx.Err()}
+	})
+
+	const timeout = 50 * time.Millisecond
+	testCases := []struct {
+		url    string
+		client *Client
+		phase  string
+	}{
+		{server.URL + "/stall", &Client{FirstByteTimeout: timeout}, "first byte"},
+		{server.URL + "/stall", &Client{Timeout: timeout}, "total"},
+		{server.URL + "/slow-body", &Client{FirstByteTimeout: time.Minute, Timeout: timeout}, "total"},
+		{server.URL + "/stall", &Client{Dialer: blackhole, ConnectTimeout: timeout}, "connect"},
+		{"https://" + silent.Addr().String(), &Client{TLSTimeout: timeout}, "TLS"},
+		{server.URL + "/stall", &Client{HTTP2: true, FirstByteTimeout: timeout}, "first byte"},
+		{server.URL + "/slow-body", &Client{HTTP2: true, Timeout: timeout}, "total"},
+		{server.URL + "/stall", &Client{HTTP2: true, Dialer: blackhole, ConnectTimeout: timeout},
+			"connect"},
+		{"https://example.com:443", &Client{Proxy: silentProxy, ConnectTimeout: timeout}, "connect"},
+		{"https://example.com:443", &Client{HTTP2: true, Proxy: silentProxy, ConnectTimeout: timeout},
+			"connect"},
+	}
+	for _, testCase := range testCases {
+		requestURL, err := ParseFuzzyHTTPUrl(testCase.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		_, err = testCase.client.Do(requestURL, ioutil.Discard, nil)
+		elapsed := time.Since(start)
+		var timeoutErr *TimeoutError
+		if !errors.As(err, &timeoutErr) || timeoutErr.Phase != testCase.phase {
+			t.Errorf("%s %+v: expected %s timeout, got %v\n", testCase.url, testCase.client,
+				testCase.phase, err)
+			continue
+		}
+		if ClassifyError(err) != ErrorTimeout {
+			t.Errorf("expected timeout error class, got %q\n", ClassifyError(err))
+		}
+		if elapsed > 10*timeout {
+			t.Errorf("%s timeout of %v took %v\n", testCase.phase, timeout, elapsed)
+		}
+	}
+
+	requestURL, _ := url.Parse(server.URL + "/stall")
+	results := DoProfile(ProfileOptions{Repetitions: 2}, requestURL,
+		&Client{FirstByteTimeout: timeout})
+	if results.ErrorClassCounts[ErrorTimeout] != 2 {
+		t.Errorf("expected 2 timeouts, got %v\n", results.ErrorClassCounts)
+	}
+}
+
+// TLS 1.3 servers may send session tickets after the handshake, which must not be
+// mistaken for the first byte of the response by either the first byte timeout
+// or the first byte time
+func TestFirstByteAfterSessionTicket(t *testing.T) {
+	const serverDelay = 300 * time.Millisecond
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(serverDelay)
+	}))
+	// Requesting a client certificate makes the server send its tickets once the
+	// client has finished the handshake, which is while the request is in flight
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	requestURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal("error parsing test server url")
+	}
+	newClient := func(firstByteTimeout time.Duration) *Client {
+		config, _ := LoadTLSConfig(true, "", "", "")
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		return &Client{TLSConfig: config, FirstByteTimeout: firstByteTimeout}
+	}
+	_, err = newClient(100*time.Millisecond).Do(requestURL, ioutil.Discard, nil)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Phase != "first byte" {
+		t.Errorf("expected first byte timeout, got %v\n", err)
+	}
+	result, err := newClient(0).Do(requestURL, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Timings.FirstByte < serverDelay {
+		t.Errorf("expected time to first byte of at least %v got %+v\n", serverDelay, result.Timings)
+	}
+}
+
+// Failures should be classified by cause, and profile reports should show how
+// many requests failed with each class along with an example message
+func TestErrorClasses(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer listener.Close()
+	// Reset each connection once the request has been read
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			textReader := textproto.NewReader(bufio.NewReader(conn))
+			for {
+				line, _ := textReader.ReadLine()
+				if line == "" {
+					break
+				}
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+	resetURL, _ := url.Parse("http://" + listener.Addr().String())
+
+	// Nothing listens on the address once the listener is closed
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	refusedURL, _ := url.Parse("http://" + closed.Addr().String())
+	closed.Close()
+
+	header := [][]string{{"HTTP/1.1 200 OK\r\n", "Not a header\r\n", "\r\n"}}
+	headerListener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("error listening on localhost")
+	}
+	defer headerListener.Close()
+	ms := &mockServer{listener: headerListener.(*net.TCPListener), responses: header}
+	go ms.start(t)
+	headerURL, _ := url.Parse("http://" + headerListener.Addr().String())
+
+	testCases := []struct {
+		url      *url.URL
+		expected ErrorClass
+	}{
+		{resetURL, ErrorReset},
+		{refusedURL, ErrorConnect},
+		{headerURL, ErrorProtocol},
+	}
+	for _, testCase := range testCases {
+		results := DoProfile(ProfileOptions{Repetitions: 2}, testCase.url, nil)
+		if results.ErrorClassCounts[testCase.expected] != 2 {
+			t.Errorf("%s: expected 2 %s errors got %v\n", testCase.url, testCase.expected,
+				results.ErrorClassCounts)
+			continue
+		}
+		example := results.ErrorExamples[testCase.expected]
+		if example == "" || !strings.Contains(results.String(), example) {
+			t.Errorf("expected example %s error %q in report:\n%s\n", testCase.expected, example,
+				results.String())
+		}
+		report := results.Report(testCase.url)
+		if report.ErrorClasses[testCase.expected] != 2 ||
+			report.ErrorExamples[testCase.expected] != example {
+			t.Errorf("unexpected JSON error classes %v and examples %v\n", report.ErrorClasses,
+				report.ErrorExamples)
+		}
+	}
+}
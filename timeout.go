@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TimeoutError is returned when a request exceeds one of the Client's timeouts
+type TimeoutError struct {
+	// Phase names the timeout that was exceeded: connect, TLS, first byte or total
+	Phase string
+	Limit time.Duration
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %v exceeded: %v", e.Phase, e.Limit, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// limit is the deadline by which a phase of a request must complete along with
+// the timeout that set it. The zero value imposes no limit.
+type limit struct {
+	deadline time.Time
+	phase    string
+	timeout  time.Duration
+}
+
+// limit returns the limit for a phase that starts now and may take up to timeout,
+// or until the deadline for the whole request if that is earlier. Zero timeouts
+// and deadlines impose no limit.
+func (c *Client) limit(phase string, timeout time.Duration, deadline time.Time) limit {
+	var l limit
+	if timeout > 0 {
+		l = limit{deadline: time.Now().Add(timeout), phase: phase, timeout: timeout}
+	}
+	if !deadline.IsZero() && (l.deadline.IsZero() || deadline.Before(l.deadline)) {
+		l = limit{deadline: deadline, phase: "total", timeout: c.Timeout}
+	}
+	return l
+}
+
+// context returns a context derived from parent that is also cancelled once the
+// limit is reached
+func (l limit) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if l.deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, l.deadline)
+}
+
+// wrap returns err as a TimeoutError if it was caused by reaching the limit
+func (l limit) wrap(err error) error {
+	if l.deadline.IsZero() || !isTimeout(err) {
+		return err
+	}
+	return &TimeoutError{Phase: l.phase, Limit: l.timeout, Err: err}
+}
+
+// isTimeout reports whether err was caused by an operation timing out
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
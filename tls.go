@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// TLSHandshakeError wraps an error that occurred while negotiating TLS with a server
+type TLSHandshakeError struct {
+	Err error
+	// PeerCertificates is the certificate chain presented by the server if the
+	// handshake failed because the chain could not be verified
+	PeerCertificates []*x509.Certificate
+}
+
+// newTLSHandshakeError wraps err, keeping any certificates the server presented
+func newTLSHandshakeError(err error) *TLSHandshakeError {
+	handshakeErr := &TLSHandshakeError{Err: err}
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		handshakeErr.PeerCertificates = verifyErr.UnverifiedCertificates
+	}
+	return handshakeErr
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return "tls handshake: " + e.Err.Error()
+}
+
+func (e *TLSHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// LoadTLSConfig builds the TLS configuration used for https requests. Server
+// certificates are verified against the system roots, or against the PEM encoded
+// certificates in caFile if it is not empty, unless insecure is set. If certFile
+// and keyFile are set the PEM encoded certificate and key they contain are
+// presented to servers that request client authentication.
+func LoadTLSConfig(insecure bool, caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a client certificate and key must be used together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// isCertificateError reports whether err was caused by a server certificate that
+// failed verification
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) ||
+		errors.As(err, &invalid)
+}
+
+// FormatTLSInfo describes the parameters negotiated for a TLS connection and the
+// certificate chain presented by the server
+func FormatTLSInfo(state *tls.ConnectionState) string {
+	var builder strings.Builder
+	version, ok := tlsVersionNames[state.Version]
+	if !ok {
+		version = fmt.Sprintf("unknown (0x%04x)", state.Version)
+	}
+	alpn := state.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	resumed := "no"
+	if state.DidResume {
+		resumed = "yes"
+	}
+	_, _ = fmt.Fprintf(&builder, "TLS version:      %s\n", version)
+	_, _ = fmt.Fprintf(&builder, "Cipher suite:     %s\n", tls.CipherSuiteName(state.CipherSuite))
+	_, _ = fmt.Fprintf(&builder, "ALPN protocol:    %s\n", alpn)
+	_, _ = fmt.Fprintf(&builder, "Session resumed:  %s\n", resumed)
+	builder.WriteString(FormatCertificateChain(state.PeerCertificates))
+	return builder.String()
+}
+
+// FormatCertificateChain describes each certificate in a chain presented by a
+// server, such as one that failed verification
+func FormatCertificateChain(certs []*x509.Certificate) string {
+	var builder strings.Builder
+	_, _ = fmt.Fprintf(&builder, "Certificate chain:\n")
+	for i, cert := range certs {
+		_, _ = fmt.Fprintf(&builder, "  %d Subject:  %s\n", i, cert.Subject)
+		if sans := subjectAltNames(cert); len(sans) > 0 {
+			_, _ = fmt.Fprintf(&builder, "    SANs:     %s\n", strings.Join(sans, ", "))
+		}
+		_, _ = fmt.Fprintf(&builder, "    Issuer:   %s\n", cert.Issuer)
+		_, _ = fmt.Fprintf(&builder, "    Expires:  %s (%s)\n",
+			cert.NotAfter.UTC().Format(time.RFC3339), expiresIn(cert.NotAfter))
+	}
+	return builder.String()
+}
+
+// subjectAltNames lists every subject alternative name in cert
+func subjectAltNames(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// expiresIn describes how long remains until a certificate expiring at notAfter
+// is no longer valid
+func expiresIn(notAfter time.Time) string {
+	remaining := time.Until(notAfter)
+	if remaining < 0 {
+		return "expired"
+	}
+	days := int(remaining.Hours() / 24)
+	if days == 1 {
+		return "in 1 day"
+	}
+	return fmt.Sprintf("in %d days", days)
+}